@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminAuthMW only lets through the requests with the admin token as a bearer token in the Authorization header
+func adminAuthMW(token string) gin.HandlerFunc {
+	expected := []byte(token)
+	return func(c *gin.Context) {
+		got := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), expected) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// adminHandlers protects the handlers of an admin endpoint with the admin token, returning false when it is not
+// configured, so the endpoint is not registered
+func adminHandlers(endpoint string, handler gin.HandlerFunc) ([]gin.HandlerFunc, bool) {
+	if app.Config.AdminToken == "" {
+		app.log().Error("the endpoint is not registered without an admin_token", endpoint)
+		return nil, false
+	}
+	return []gin.HandlerFunc{adminAuthMW(app.Config.AdminToken), handler}, true
+}
@@ -0,0 +1,256 @@
+package metrics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	router "github.com/luraproject/lura/v2/router/gin"
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+const (
+	authSegmentKey = "krakendNewRelicAuthSegment"
+
+	// AuthFailureErrorClass is the class of the errors noticed when the authentication fails
+	AuthFailureErrorClass = "AuthenticationFailure"
+
+	// RedactMask only keeps the last characters of the claim
+	RedactMask = "mask"
+	// RedactHash replaces the claim with its hash
+	RedactHash = "hash"
+	// RedactDrop does not copy the claim
+	RedactDrop = "drop"
+
+	defaultTokenHeader = "Authorization"
+)
+
+// AuthConfig configures the authentication instrumentation
+type AuthConfig struct {
+	// Claims are copied to the transaction as auth.{claim} attributes, nested claims are separated by dots
+	Claims []string `json:"claims"`
+	// Redact maps the claims to their redaction, mask, hash or drop
+	Redact map[string]string `json:"redact"`
+	// Header is the header holding the token, Authorization by default
+	Header string `json:"header"`
+	// Cookie is the cookie holding the token when it is not in the header
+	Cookie string `json:"cookie"`
+}
+
+func validateAuthConfig(conf AuthConfig) error {
+	for claim, redaction := range conf.Redact {
+		switch redaction {
+		case RedactMask, RedactHash, RedactDrop:
+		default:
+			return fmt.Errorf("unknown redaction %q for the claim %s", redaction, claim)
+		}
+	}
+	return nil
+}
+
+// authSegment is shared between the handler measuring the authentication and the handler run once it succeeded
+type authSegment struct {
+	segment   Segment
+	succeeded bool
+}
+
+// AuthHandlerFactory measures the authentication done by the auth handler factory wrapper, e.g. the JWT validator,
+// as a segment named ({segmentName}) {endpoint}. The segment ends when the request reaches the handlers of next.
+// When it does not, the authentication failed and its reason is noticed as an error.
+// Once the authentication succeeded, the configured claims of the token are copied to the transaction and the client
+// is identified from its claim.
+func AuthHandlerFactory(
+	segmentName string,
+	auth func(router.HandlerFactory) router.HandlerFactory,
+	next router.HandlerFactory,
+) router.HandlerFactory {
+	if app == nil {
+		return auth(next)
+	}
+
+	authenticated := auth(
+		func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+			handler := next(cfg, p)
+			return func(c *gin.Context) {
+				if s, ok := c.Get(authSegmentKey); ok {
+					segment := s.(*authSegment)
+					segment.succeeded = true
+					segment.segment.End()
+					if txn := app.TransactionManager.TransactionFromContext(c); txn != nil {
+						copyClaims(txn, c.Request, app.Config.Auth)
+						identifyClaimClient(txn, c)
+					}
+				}
+				handler(c)
+			}
+		},
+	)
+
+	return func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handler := authenticated(cfg, p)
+		name := fmt.Sprintf("(%s) %s", segmentName, cfg.Endpoint)
+		return func(c *gin.Context) {
+			txn := app.TransactionManager.TransactionFromContext(c)
+			if txn == nil {
+				handler(c)
+				return
+			}
+
+			txn.SetName(cfg.Endpoint)
+			addClientAttributes(txn, c)
+			segment := &authSegment{segment: startSegment(txn, name)}
+			c.Set(authSegmentKey, segment)
+			handler(c)
+			if segment.succeeded {
+				return
+			}
+
+			segment.segment.End()
+			noticeAuthFailure(txn, cfg, c)
+		}
+	}
+}
+
+func noticeAuthFailure(txn Transaction, cfg *config.EndpointConfig, c *gin.Context) {
+	reason := http.StatusText(c.Writer.Status())
+	if err := c.Errors.Last(); err != nil {
+		reason = err.Error()
+	}
+
+	addAttribute(txn, "auth.failed", true)
+	noticeError(
+		txn,
+		newrelic.Error{
+			Message: reason,
+			Class:   AuthFailureErrorClass,
+			Attributes: map[string]interface{}{
+				"auth.endpoint":   cfg.Endpoint,
+				"auth.reason":     reason,
+				"http.statusCode": c.Writer.Status(),
+			},
+		},
+	)
+}
+
+// copyClaims adds the configured claims of the token to the transaction, after their redaction
+func copyClaims(txn Transaction, r *http.Request, conf AuthConfig) {
+	if len(conf.Claims) == 0 {
+		return
+	}
+	claims, err := tokenClaims(r, conf.Header, conf.Cookie)
+	if err != nil {
+		return
+	}
+
+	for _, name := range conf.Claims {
+		value, ok := claimValue(claims, name)
+		if !ok {
+			continue
+		}
+		switch conf.Redact[name] {
+		case RedactDrop:
+			continue
+		case RedactMask:
+			value = maskSecret(value)
+		case RedactHash:
+			value = hashValue(app.hashKey, value)
+		}
+		addAttribute(txn, "auth."+name, value)
+	}
+}
+
+// tokenClaims decodes the claims of the JWT found in the header or in the cookie.
+// The signature is not verified, the token is expected to be validated by the auth handler.
+func tokenClaims(r *http.Request, header, cookie string) (map[string]interface{}, error) {
+	if header == "" {
+		header = defaultTokenHeader
+	}
+	token := r.Header.Get(header)
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = token[7:]
+	}
+	if token == "" && cookie != "" {
+		if c, err := r.Cookie(cookie); err == nil {
+			token = c.Value
+		}
+	}
+
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, errors.New("the token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// claimValue returns the claim as a string, the nested claims being separated by dots and the lists joined by commas
+func claimValue(claims map[string]interface{}, name string) (string, bool) {
+	var value interface{} = claims
+	for _, key := range strings.Split(name, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = m[key]; !ok {
+			return "", false
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return strings.Join(values, ","), true
+	case nil:
+		return "", false
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+var errHashKeyRequired = errors.New("the hash_key is required to hash the API keys and the claims")
+
+// validateHashKey checks the hash_key is defined when the API keys or the claims are hashed, since a random key would
+// give different hashes for the same value across restarts and gateways
+func validateHashKey(conf Config) error {
+	if conf.HashKey != "" {
+		return nil
+	}
+	if conf.Client.APIKeyHeader != "" {
+		return errHashKeyRequired
+	}
+	for _, redaction := range conf.Auth.Redact {
+		if redaction == RedactHash {
+			return errHashKeyRequired
+		}
+	}
+	return nil
+}
+
+// hashValue returns the HMAC of the value with the key, so the values can not be found back from their hash
+// without the key
+func hashValue(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
@@ -0,0 +1,190 @@
+package metrics
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	router "github.com/luraproject/lura/v2/router/gin"
+	"github.com/newrelic/go-agent/v3/newrelic"
+	"github.com/stretchr/testify/assert"
+)
+
+func testToken(claims string) string {
+	return "eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJl"
+}
+
+// fakeValidator rejects the requests without a token, like the JWT validator
+func fakeValidator(next router.HandlerFactory) router.HandlerFactory {
+	return func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handler := next(cfg, p)
+		return func(c *gin.Context) {
+			if c.GetHeader("Authorization") == "" {
+				_ = c.AbortWithError(http.StatusUnauthorized, errors.New("token not found"))
+				return
+			}
+			handler(c)
+		}
+	}
+}
+
+func TestAuthHandlerFactory(t *testing.T) {
+	tests := []struct {
+		name           string
+		conf           AuthConfig
+		token          string
+		wantStatus     int
+		wantAttributes map[string]interface{}
+		wantErrors     []error
+	}{
+		{
+			name:           "given a valid token, it should measure the authentication",
+			token:          testToken(`{"sub":"gopher"}`),
+			wantStatus:     http.StatusOK,
+			wantAttributes: map[string]interface{}{},
+		},
+		{
+			name: "given claims to copy, it should add them to the transaction after their redaction",
+			conf: AuthConfig{
+				Claims: []string{"sub", "tenant.id", "roles", "email", "secret", "missing"},
+				Redact: map[string]string{"sub": RedactHash, "email": RedactMask, "secret": RedactDrop},
+			},
+			token: testToken(
+				`{"sub":"gopher","tenant":{"id":42},"roles":["admin","user"],"email":"gopher@golang.org","secret":"s"}`,
+			),
+			wantStatus: http.StatusOK,
+			wantAttributes: map[string]interface{}{
+				"auth.sub":       hashValue([]byte("hash-key"), "gopher"),
+				"auth.tenant.id": "42",
+				"auth.roles":     "admin,user",
+				"auth.email":     "****.org",
+			},
+		},
+		{
+			name:       "given an invalid token, it should notice the failure reason",
+			conf:       AuthConfig{Claims: []string{"sub"}},
+			wantStatus: http.StatusUnauthorized,
+			wantAttributes: map[string]interface{}{
+				"auth.failed": true,
+			},
+			wantErrors: []error{
+				newrelic.Error{
+					Message: "token not found",
+					Class:   AuthFailureErrorClass,
+					Attributes: map[string]interface{}{
+						"auth.endpoint":   "/users",
+						"auth.reason":     "token not found",
+						"http.statusCode": http.StatusUnauthorized,
+					},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				recorder := NewRecorder()
+				app = &Application{
+					TransactionManager: recorder,
+					NRApplication:      recorder,
+					Config:             Config{InstrumentationRate: 100, Auth: tt.conf},
+					hashKey:            []byte("hash-key"),
+				}
+				defer func() { app = nil }()
+
+				handler := AuthHandlerFactory(
+					"auth", fakeValidator, func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+						return func(c *gin.Context) {
+							c.String(http.StatusOK, "ok")
+						}
+					},
+				)(&config.EndpointConfig{Method: http.MethodGet, Endpoint: "/users"}, nil)
+
+				gin.SetMode(gin.TestMode)
+				e := gin.New()
+				e.Use(Middleware())
+				e.GET("/users", handler)
+				req := httptest.NewRequest(http.MethodGet, "/users", nil)
+				if tt.token != "" {
+					req.Header.Set("Authorization", "Bearer "+tt.token)
+				}
+				w := httptest.NewRecorder()
+				e.ServeHTTP(w, req)
+				assert.Equal(t, tt.wantStatus, w.Code)
+
+				txn, ok := recorder.Transaction("/users")
+				if !assert.True(t, ok) {
+					return
+				}
+				segment, ok := txn.Segment("(auth) /users")
+				if assert.True(t, ok) {
+					assert.True(t, segment.Ended)
+				}
+				for k, v := range tt.wantAttributes {
+					assert.Equal(t, v, txn.Attributes[k], k)
+				}
+				assert.NotContains(t, txn.Attributes, "auth.secret")
+				assert.NotContains(t, txn.Attributes, "auth.missing")
+				assert.Equal(t, tt.wantErrors, txn.Errors)
+			},
+		)
+	}
+}
+
+func Test_hashValue(t *testing.T) {
+	assert.Equal(t, hashValue([]byte("key"), "gopher"), hashValue([]byte("key"), "gopher"))
+	assert.NotEqual(t, hashValue([]byte("key"), "gopher"), hashValue([]byte("other"), "gopher"))
+	assert.Len(t, hashValue([]byte("key"), "gopher"), 16)
+}
+
+func Test_tokenClaims(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		cookie     string
+		wantClaims map[string]interface{}
+		wantErr    bool
+	}{
+		{
+			name:       "given a bearer token, it should decode its claims",
+			header:     "Bearer " + testToken(`{"sub":"gopher"}`),
+			wantClaims: map[string]interface{}{"sub": "gopher"},
+		},
+		{
+			name:       "given a token in the cookie, it should decode its claims",
+			cookie:     testToken(`{"sub":"gopher"}`),
+			wantClaims: map[string]interface{}{"sub": "gopher"},
+		},
+		{
+			name:    "given an opaque token, it should return an error",
+			header:  "Bearer opaque",
+			wantErr: true,
+		},
+		{
+			name:    "given a token with invalid claims, it should return an error",
+			header:  "Bearer a.bm90IGpzb24.c",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, "/users", nil)
+				if tt.header != "" {
+					req.Header.Set("Authorization", tt.header)
+				}
+				if tt.cookie != "" {
+					req.AddCookie(&http.Cookie{Name: "token", Value: tt.cookie})
+				}
+				claims, err := tokenClaims(req, "", "token")
+				assert.Equal(t, tt.wantErr, err != nil)
+				assert.Equal(t, tt.wantClaims, claims)
+			},
+		)
+	}
+}
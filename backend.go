@@ -2,9 +2,11 @@ package metrics
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/luraproject/lura/v2/config"
 	"github.com/luraproject/lura/v2/proxy"
@@ -17,7 +19,25 @@ func BackendFactory(segmentName string, next proxy.BackendFactory) proxy.Backend
 	}
 
 	return func(cfg *config.Backend) proxy.Proxy {
-		return NewBackend(segmentName, next(cfg))
+		if cfg == nil {
+			return NewBackend(segmentName, next(cfg))
+		}
+		classification, err := statusCodeClassificationFor(cfg.ExtraConfig)
+		if err != nil {
+			app.log().Error("invalid status_codes for the backend", cfg.URLPattern, err.Error())
+		}
+		if isGRPCBackend(cfg) {
+			registerBackend("grpc", cfg, classification)
+			return newGRPCBackend(classification, cfg, next(cfg))
+		}
+		if classification != app.Config.StatusCodes && !backendReportsStatusCodes(cfg) {
+			app.log().Warning(
+				"the status codes of the backend", cfg.URLPattern,
+				"can not be classified without return_error_code or return_error_details",
+			)
+		}
+		registerBackend("http", cfg, classification)
+		return newBackend(segmentName, classification, cfg.URLPattern, cfg.Timeout, next(cfg))
 	}
 }
 
@@ -27,37 +47,92 @@ func NewBackend(segmentName string, next proxy.Proxy) proxy.Proxy {
 		return next
 	}
 
+	return newBackend(segmentName, app.Config.StatusCodes, "", 0, next)
+}
+
+func newBackend(
+	segmentName string,
+	classification *StatusCodeClassification,
+	urlPattern string,
+	timeout time.Duration,
+	next proxy.Proxy,
+) proxy.Proxy {
 	return func(ctx context.Context, proxyReq *proxy.Request) (*proxy.Response, error) {
-		tx := app.TransactionManager.TransactionFromContext(ctx)
+		ctx, tx := transactionFor(ctx, proxyReq)
 		if tx == nil {
-			return next(ctx, proxyReq)
+			ctx, tx = startStandaloneTransaction(ctx, backendTransactionName(proxyReq, urlPattern))
+			if tx == nil {
+				return next(ctx, proxyReq)
+			}
+			defer tx.End()
 		}
 
 		req, err := toHttpRequest(proxyReq)
 		if err != nil {
-			return nil, err
+			return next(ctx, proxyReq)
 		}
 
 		externalSegment := app.TransactionManager.StartExternalSegment(tx, req)
-		proxyReq.Headers = req.Header
-		defer func() {
-			externalSegment.End()
-			if req.Body != nil {
-				req.Body.Close()
-			}
-		}()
+		defer externalSegment.End()
+		deadline := deadlineAttributes(ctx, externalSegment, timeout)
+
+		// the trace headers only belong to this call, so they are set on a copy of the request
+		// instead of the one that may be shared with the sibling backends
+		backendReq := proxyReq.Clone()
+		if !provisionalTransaction(ctx) {
+			backendReq.Headers = req.Header
+		}
 
-		resp, err := next(ctx, proxyReq)
+		var call *backendCall
+		if app.Config.Cache.Enabled || app.Config.Retries.Enabled || app.Config.PayloadSizes.Enabled {
+			ctx, call = contextWithBackendCall(ctx, urlPattern)
+		}
+
+		start := time.Now()
+		resp, err := next(ctx, &backendReq)
+		statusCode := errorStatusCode(err)
 		if err == nil {
-			externalSegment.SetStatusCode(resp.Metadata.StatusCode)
+			statusCode = resp.Metadata.StatusCode
+			externalSegment.SetStatusCode(statusCode)
+			if app.Config.PayloadSizes.Enabled {
+				recordBackendResponseSize(externalSegment, call, resp, req.URL.Host, urlPattern)
+			}
+			if app.Config.Cache.Enabled {
+				recordCacheStatus(externalSegment, call, resp, req.URL.Host, urlPattern)
+			}
+			if resp.Io != nil {
+				_, sizeKnown := backendResponseSize(resp, nil)
+				resp.Io = streamBackendBody(ctx, tx, resp.Io, req.URL.Host, urlPattern, sizeKnown)
+			}
+		}
+		if app.Config.Retries.Enabled {
+			recordRetries(ctx, tx, externalSegment, call)
+		}
+		if details := requestDetailsFromContext(ctx); details != nil {
+			details.addBackend(req.URL, time.Since(start), statusCode)
+		}
+		if source := timeoutSource(ctx, err); source != "" {
+			if s, ok := externalSegment.(AttributeAdder); ok {
+				s.AddAttribute("timeout.source", source)
+			}
+			deadline["backend.url"] = req.URL.String()
+			noticeTimeout(tx, source, err, deadline)
+		} else {
+			noticeStatusCode(tx, classification, statusCode, map[string]interface{}{"backend.url": req.URL.String()})
 		}
 
 		return resp, err
 	}
 }
 
+// toHttpRequest creates the request used to describe the call to the backend.
+// The body of the proxy request is never attached to it, so it is neither consumed nor closed
+// and it stays available for the backend and any retry.
 func toHttpRequest(req *proxy.Request) (*http.Request, error) {
-	requestToBackend, err := http.NewRequest(strings.ToTitle(req.Method), req.URL.String(), req.Body)
+	if req.URL == nil {
+		return nil, errors.New("the request has no url")
+	}
+	requestToBackend, err := http.NewRequest(strings.ToUpper(req.Method), req.URL.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -67,13 +142,33 @@ func toHttpRequest(req *proxy.Request) (*http.Request, error) {
 		copy(tmp, vs)
 		requestToBackend.Header[k] = tmp
 	}
-	if req.Body != nil {
-		if v, ok := req.Headers["Content-Length"]; ok && len(v) == 1 && v[0] != "chunked" {
-			if size, err := strconv.Atoi(v[0]); err == nil {
-				requestToBackend.ContentLength = int64(size)
-			}
+	if req.Body == nil {
+		return requestToBackend, nil
+	}
+
+	if isChunked(requestToBackend.Header) {
+		requestToBackend.TransferEncoding = []string{"chunked"}
+		requestToBackend.ContentLength = -1
+		return requestToBackend, nil
+	}
+
+	requestToBackend.ContentLength = -1
+	if v := requestToBackend.Header.Values("Content-Length"); len(v) == 1 {
+		if size, err := strconv.ParseInt(v[0], 10, 64); err == nil && size >= 0 {
+			requestToBackend.ContentLength = size
 		}
 	}
 
 	return requestToBackend, nil
 }
+
+func isChunked(h http.Header) bool {
+	for _, v := range h.Values("Transfer-Encoding") {
+		for _, encoding := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(encoding), "chunked") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -1,15 +1,26 @@
 package metrics
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/golang/mock/gomock"
 	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/encoding"
+	"github.com/luraproject/lura/v2/logging"
 	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/transport/http/client"
+	"github.com/newrelic/go-agent/v3/newrelic"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -181,6 +192,69 @@ func TestBackendFactory(t *testing.T) {
 			}(),
 			wantErr: assert.Error,
 		},
+		{
+			name: "given the backend status code is classified as an error, it should notice the error",
+			args: args{
+				request: &proxy.Request{
+					Method: "GET",
+					URL: func() *url.URL {
+						u, err := url.Parse("http://localhost:8080/some-endpoint")
+						if err != nil {
+							t.Fatal(err)
+						}
+
+						return u
+					}(),
+				},
+			},
+			fields: fields{
+				segmentName: "segment1",
+				nextFactory: func(remote *config.Backend) proxy.Proxy {
+					return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+						return nil, responseError(http.StatusTooManyRequests)
+					}
+				},
+				cfg: &config.Backend{},
+			},
+			app: func() *Application {
+				return &Application{
+					TransactionManager: func() TransactionManager {
+						seg := NewMockTransactionEndStatusCodeSetter(ctrl)
+						tx := newMockTransaction(ctrl)
+						tp := NewMockTransactionManager(ctrl)
+
+						tp.EXPECT().TransactionFromContext(gomock.AssignableToTypeOf(context.Background())).
+							Times(1).
+							Return(tx)
+
+						tp.EXPECT().StartExternalSegment(tx, gomock.Any()).
+							Times(1).
+							Return(seg)
+
+						seg.EXPECT().End().
+							Times(1)
+
+						tx.errors.EXPECT().NoticeError(
+							newrelic.Error{
+								Message: "429 Too Many Requests",
+								Class:   "429",
+								Attributes: map[string]interface{}{
+									"http.statusCode": 429,
+									"backend.url":     "http://localhost:8080/some-endpoint",
+								},
+							},
+						).Times(1)
+
+						return tp
+					}(),
+					NRApplication: NewMockNRApplication(ctrl),
+					Config: Config{
+						StatusCodes: &StatusCodeClassification{ErrorStatusCodes: []int{429}},
+					},
+				}
+			}(),
+			wantErr: assert.Error,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(
@@ -195,3 +269,275 @@ func TestBackendFactory(t *testing.T) {
 		)
 	}
 }
+
+type responseError int
+
+func (e responseError) Error() string {
+	return http.StatusText(int(e))
+}
+
+func (e responseError) StatusCode() int {
+	return int(e)
+}
+
+type trackingBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *trackingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestNewBackend_requestBody(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	type args struct {
+		method  string
+		headers map[string][]string
+		body    string
+	}
+	tests := []struct {
+		name                 string
+		args                 args
+		wantContentLength    int64
+		wantTransferEncoding []string
+	}{
+		{
+			name: "given a POST request with content length, it should describe the request size without reading the body",
+			args: args{
+				method:  http.MethodPost,
+				headers: map[string][]string{"Content-Length": {"13"}},
+				body:    `{"id": "abc"}`,
+			},
+			wantContentLength: 13,
+		},
+		{
+			name: "given a PUT request with chunked transfer encoding, it should mark the request as chunked",
+			args: args{
+				method:  http.MethodPut,
+				headers: map[string][]string{"Transfer-Encoding": {"chunked"}},
+				body:    `{"id": "abc"}`,
+			},
+			wantContentLength:    -1,
+			wantTransferEncoding: []string{"chunked"},
+		},
+		{
+			name: "given a POST request without content length, it should mark the length as unknown",
+			args: args{
+				method: http.MethodPost,
+				body:   `{"id": "abc"}`,
+			},
+			wantContentLength: -1,
+		},
+		{
+			name: "given a PUT request with an invalid content length, it should mark the length as unknown",
+			args: args{
+				method:  http.MethodPut,
+				headers: map[string][]string{"Content-Length": {"chunked"}},
+				body:    `{"id": "abc"}`,
+			},
+			wantContentLength: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				body := &trackingBody{Reader: strings.NewReader(tt.args.body)}
+				u, err := url.Parse("http://localhost:8080/some-endpoint")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				seg := NewMockTransactionEndStatusCodeSetter(ctrl)
+				tx := NewMockTransaction(ctrl)
+				tm := NewMockTransactionManager(ctrl)
+				tm.EXPECT().TransactionFromContext(gomock.Any()).Return(tx)
+				tm.EXPECT().StartExternalSegment(tx, gomock.Any()).DoAndReturn(
+					func(txn Transaction, req *http.Request) TransactionEndStatusCodeSetter {
+						assert.Equal(t, tt.args.method, req.Method)
+						assert.Nil(t, req.Body)
+						assert.Equal(t, tt.wantContentLength, req.ContentLength)
+						assert.Equal(t, tt.wantTransferEncoding, req.TransferEncoding)
+						return seg
+					},
+				)
+				seg.EXPECT().SetStatusCode(http.StatusCreated)
+				seg.EXPECT().End()
+				app = &Application{TransactionManager: tm, NRApplication: NewMockNRApplication(ctrl)}
+
+				backend := NewBackend(
+					"backend", func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+						b, err := io.ReadAll(request.Body)
+						if err != nil {
+							return nil, err
+						}
+						assert.Equal(t, tt.args.body, string(b))
+
+						return &proxy.Response{Metadata: proxy.Metadata{StatusCode: http.StatusCreated}}, nil
+					},
+				)
+
+				_, err = backend(
+					context.Background(), &proxy.Request{
+						Method:  tt.args.method,
+						URL:     u,
+						Body:    body,
+						Headers: tt.args.headers,
+					},
+				)
+				assert.NoError(t, err)
+				assert.False(t, body.closed, "the proxied body must not be closed by the instrumentation")
+			},
+		)
+	}
+}
+
+func TestNewBackend_traceHeaders(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	var spanID int64
+	tx := NewMockTransaction(ctrl)
+	tm := NewMockTransactionManager(ctrl)
+	tm.EXPECT().TransactionFromContext(gomock.Any()).Return(tx).Times(2)
+	tm.EXPECT().StartExternalSegment(tx, gomock.Any()).DoAndReturn(
+		func(txn Transaction, req *http.Request) TransactionEndStatusCodeSetter {
+			req.Header.Set("Traceparent", fmt.Sprintf("00-trace-%d-01", atomic.AddInt64(&spanID, 1)))
+
+			seg := NewMockTransactionEndStatusCodeSetter(ctrl)
+			seg.EXPECT().SetStatusCode(http.StatusOK)
+			seg.EXPECT().End()
+			return seg
+		},
+	).Times(2)
+	app = &Application{TransactionManager: tm, NRApplication: NewMockNRApplication(ctrl)}
+
+	u, err := url.Parse("http://localhost:8080/some-endpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &proxy.Request{
+		Method:  http.MethodGet,
+		URL:     u,
+		Headers: map[string][]string{"X-Original": {"value"}},
+	}
+
+	received := make(chan string, 2)
+	backend := NewBackend(
+		"backend", func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			assert.Equal(t, []string{"value"}, request.Headers["X-Original"])
+			received <- http.Header(request.Headers).Get("Traceparent")
+			return &proxy.Response{Metadata: proxy.Metadata{StatusCode: http.StatusOK}}, nil
+		},
+	)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := backend(context.Background(), req)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	close(received)
+
+	spans := map[string]struct{}{}
+	for traceparent := range received {
+		assert.NotEmpty(t, traceparent)
+		spans[traceparent] = struct{}{}
+	}
+	assert.Len(t, spans, 2, "each backend call should carry its own span id")
+	assert.Equal(t, map[string][]string{"X-Original": {"value"}}, req.Headers)
+}
+
+func TestBackendFactory_statusHandlers(t *testing.T) {
+	backendServer := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTooManyRequests)
+			},
+		),
+	)
+	defer backendServer.Close()
+	backendURL, _ := url.Parse(backendServer.URL + "/users")
+
+	tests := []struct {
+		name        string
+		httpConfig  map[string]interface{}
+		wantErrors  []error
+		wantWarning bool
+	}{
+		{
+			name:        "given the default status handler, it should warn that the status codes can not be classified",
+			wantErrors:  []error{},
+			wantWarning: true,
+		},
+		{
+			name:       "given return_error_code, it should classify the status code of the error",
+			httpConfig: map[string]interface{}{"return_error_code": true},
+			wantErrors: []error{
+				newrelic.Error{
+					Message:    "429 Too Many Requests",
+					Class:      "429",
+					Attributes: map[string]interface{}{"http.statusCode": 429, "backend.url": backendURL.String()},
+				},
+			},
+		},
+		{
+			name:       "given return_error_details, it should classify the status code of the response",
+			httpConfig: map[string]interface{}{"return_error_details": "backend"},
+			wantErrors: []error{
+				newrelic.Error{
+					Message:    "429 Too Many Requests",
+					Class:      "429",
+					Attributes: map[string]interface{}{"http.statusCode": 429, "backend.url": backendURL.String()},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				buf := &bytes.Buffer{}
+				logger, err := logging.NewLogger("WARNING", buf, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				recorder := NewRecorder()
+				app = &Application{
+					TransactionManager: recorder,
+					NRApplication:      recorder,
+					Config:             Config{InstrumentationRate: 100, StatusCodes: &StatusCodeClassification{}},
+					logger:             logger,
+				}
+				defer func() { app = nil }()
+
+				extraConfig := config.ExtraConfig{
+					Namespace: map[string]interface{}{
+						"status_codes": map[string]interface{}{"error_status_codes": []int{429}},
+					},
+				}
+				if tt.httpConfig != nil {
+					extraConfig[client.Namespace] = tt.httpConfig
+				}
+				backendConfig := &config.Backend{
+					Method:      http.MethodGet,
+					URLPattern:  "/users",
+					Decoder:     encoding.JSONDecoder,
+					ExtraConfig: extraConfig,
+				}
+				p := BackendFactory("backend", proxy.HTTPProxyFactory(backendServer.Client()))(backendConfig)
+
+				ctx, txn := recorder.StartTransactionContext(context.Background(), "/users")
+				_, _ = p(ctx, &proxy.Request{Method: http.MethodGet, URL: backendURL, Headers: map[string][]string{}})
+				txn.End()
+
+				recorded, _ := recorder.Transaction("/users")
+				assert.Equal(t, tt.wantErrors, append([]error{}, recorded.Errors...))
+				assert.Equal(t, tt.wantWarning, strings.Contains(buf.String(), "can not be classified"))
+			},
+		)
+	}
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// contextTransactionStarter is implemented by the applications starting their own transactions
+type contextTransactionStarter interface {
+	StartTransactionContext(ctx context.Context, name string) (context.Context, Transaction)
+}
+
+// StartBackgroundTransaction starts a non-web transaction, e.g. for scheduled work, and returns a context holding it,
+// so the backends and proxies called with it are instrumented. The transaction is nil when the module is disabled.
+func StartBackgroundTransaction(ctx context.Context, name string) (context.Context, Transaction) {
+	if app == nil {
+		return ctx, nil
+	}
+	if s, ok := app.NRApplication.(contextTransactionStarter); ok {
+		return s.StartTransactionContext(ctx, name)
+	}
+
+	txn := app.NRApplication.StartTransaction(name)
+	if txn == nil {
+		return ctx, nil
+	}
+	return newrelic.NewContext(ctx, txn), txn
+}
+
+// AsyncAgentProxyFactory creates a proxy factory starting a background transaction named AsyncAgent/{agent}
+// for every message processed by the async agents, sampled with the rate.
+// Only wrap the proxy factory of the async agents with it. The messages processed with a transaction already in their
+// context are not instrumented again, and the decision of the router middleware comes first when the context went
+// through it: the requests excluded or not sampled are not instrumented.
+func AsyncAgentProxyFactory(next proxy.Factory) proxy.FactoryFunc {
+	if app == nil {
+		return next.New
+	}
+	return proxy.FactoryFunc(
+		func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+			next, err := next.New(cfg)
+			if err != nil {
+				return proxy.NoopProxy, err
+			}
+			return newAsyncAgentProxy(cfg.Endpoint, next), nil
+		},
+	)
+}
+
+func newAsyncAgentProxy(agent string, next proxy.Proxy) proxy.Proxy {
+	name := fmt.Sprintf("AsyncAgent/%s", agent)
+	return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		if app.TransactionManager.TransactionFromContext(ctx) != nil {
+			return next(ctx, req)
+		}
+		if excluded, sampledOut := routerDecision(ctx); excluded || sampledOut || !sampled(app.SamplingRate()) {
+			return next(ctx, req)
+		}
+
+		ctx, txn := StartBackgroundTransaction(ctx, name)
+		if txn == nil {
+			return next(ctx, req)
+		}
+		defer txn.End()
+
+		addAttribute(txn, "async.agent", agent)
+		resp, err := next(ctx, req)
+		if err != nil {
+			noticeError(txn, err)
+		}
+		return resp, err
+	}
+}
+
+// sampled tells whether a transaction is started with the sampling rate
+func sampled(rate int) bool {
+	if rate >= 100 {
+		return true
+	}
+	return rate > 0 && rand.Float64() <= float64(rate)/100.0
+}
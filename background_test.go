@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsyncAgentProxyFactory(t *testing.T) {
+	tests := []struct {
+		name             string
+		rate             int
+		withTransaction  bool
+		routerKey        string
+		backendErr       error
+		wantTransactions []string
+		wantErrors       int
+	}{
+		{
+			name:             "given a message, it should trace its processing in a background transaction",
+			rate:             100,
+			wantTransactions: []string{"AsyncAgent/orders"},
+		},
+		{
+			name:             "given the processing fails, it should notice the error",
+			rate:             100,
+			backendErr:       errors.New("backend unavailable"),
+			wantTransactions: []string{"AsyncAgent/orders"},
+			wantErrors:       1,
+		},
+		{
+			name:             "given a message not sampled, it should not start a transaction",
+			rate:             0,
+			wantTransactions: []string{},
+		},
+		{
+			name:             "given a transaction in the context, it should not start another one",
+			rate:             100,
+			withTransaction:  true,
+			wantTransactions: []string{"parent"},
+		},
+		{
+			name:             "given a request excluded by the router, it should not start a transaction",
+			rate:             100,
+			routerKey:        excludedKey,
+			wantTransactions: []string{},
+		},
+		{
+			name:             "given a request not sampled by the router, it should not start a transaction",
+			rate:             100,
+			routerKey:        sampledOutKey,
+			wantTransactions: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				recorder := NewRecorder()
+				app = &Application{
+					TransactionManager: recorder,
+					NRApplication:      recorder,
+					Config:             Config{InstrumentationRate: tt.rate},
+				}
+				defer func() { app = nil }()
+
+				backend := NewBackend(
+					"backend", func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+						if tt.backendErr != nil {
+							return nil, tt.backendErr
+						}
+						return &proxy.Response{IsComplete: true, Metadata: proxy.Metadata{StatusCode: http.StatusOK}}, nil
+					},
+				)
+				pf := AsyncAgentProxyFactory(
+					proxy.FactoryFunc(
+						func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+							return backend, nil
+						},
+					),
+				)
+				p, err := pf.New(&config.EndpointConfig{Endpoint: "orders"})
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				ctx := context.Background()
+				if tt.routerKey != "" {
+					ctx = context.WithValue(ctx, tt.routerKey, true)
+				}
+				var parent Transaction
+				if tt.withTransaction {
+					ctx, parent = recorder.StartTransactionContext(ctx, "parent")
+				}
+				backendURL, _ := url.Parse("http://backend:8080/orders")
+				_, err = p(ctx, &proxy.Request{Method: http.MethodPost, URL: backendURL, Headers: map[string][]string{}})
+				assert.Equal(t, tt.backendErr, err)
+				if parent != nil {
+					parent.End()
+				}
+
+				names := []string{}
+				for _, txn := range recorder.Transactions() {
+					names = append(names, txn.Name)
+					assert.True(t, txn.Ended)
+					assert.Equal(t, []string{"External/backend:8080/http/POST"}, txn.SegmentNames())
+					assert.Len(t, txn.Errors, tt.wantErrors)
+				}
+				assert.Equal(t, tt.wantTransactions, names)
+			},
+		)
+	}
+}
+
+func TestStartBackgroundTransaction(t *testing.T) {
+	t.Run(
+		"given the module is disabled, it should not start a transaction", func(t *testing.T) {
+			ctx, txn := StartBackgroundTransaction(context.Background(), "job")
+			assert.Nil(t, txn)
+			assert.Equal(t, context.Background(), ctx)
+		},
+	)
+
+	t.Run(
+		"given the agent does not start the transaction, it should return none", func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			nrApp := NewMockNRApplication(ctrl)
+			nrApp.EXPECT().StartTransaction("job").Return(nil)
+			app = &Application{TransactionManager: newrelicWrapper{}, NRApplication: nrApp}
+			defer func() { app = nil }()
+
+			_, txn := StartBackgroundTransaction(context.Background(), "job")
+			assert.Nil(t, txn)
+		},
+	)
+
+	t.Run(
+		"given the recorder, it should start a recorded transaction", func(t *testing.T) {
+			recorder := NewRecorder()
+			app = &Application{TransactionManager: recorder, NRApplication: recorder}
+			defer func() { app = nil }()
+
+			ctx, txn := StartBackgroundTransaction(context.Background(), "job")
+			assert.Equal(t, txn, app.TransactionManager.TransactionFromContext(ctx))
+			txn.End()
+			_, ok := recorder.Transaction("job")
+			assert.True(t, ok)
+		},
+	)
+}
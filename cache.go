@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/transport/http/client"
+)
+
+const (
+	cacheHitMetric = "Custom/KrakenD/CacheHit/"
+	// cacheLibrary replaces http in the name of the external segments served from the cache
+	cacheLibrary = "cache"
+	// fromCacheHeader is set by the httpcache transport on the responses served from the cache
+	fromCacheHeader = "X-From-Cache"
+)
+
+// CacheConfig configures the instrumentation of the backend responses served from the cache
+type CacheConfig struct {
+	Enabled  bool `json:"enabled"`
+	Segments bool `json:"segments"`
+	Metrics  bool `json:"metrics"`
+}
+
+// externalSegmentLibrarySetter is implemented by the external segments whose library can be changed before they end
+type externalSegmentLibrarySetter interface {
+	setLibrary(library string)
+}
+
+type backendCallKey struct{}
+
+// backendCall is shared between the backend middleware and the http client of a backend call.
+// The 64-bit counter comes first, so it is aligned for the atomic operations on 32-bit platforms.
+type backendCall struct {
+	attemptCount int64
+	urlPattern   string
+	cacheHit     int32
+	responseBody atomic.Value
+}
+
+// attempt counts an attempt of the call, returning its number
+func (c *backendCall) attempt() int64 {
+	return atomic.AddInt64(&c.attemptCount, 1)
+}
+
+func (c *backendCall) attempts() int64 {
+	return atomic.LoadInt64(&c.attemptCount)
+}
+
+func (c *backendCall) markCacheHit() {
+	atomic.StoreInt32(&c.cacheHit, 1)
+}
+
+func (c *backendCall) servedFromCache() bool {
+	return atomic.LoadInt32(&c.cacheHit) == 1
+}
+
+// countResponseBody keeps the body of the last response of the call, counting the bytes read from it
+func (c *backendCall) countResponseBody(resp *http.Response) {
+	body := &countingReadCloser{ReadCloser: resp.Body}
+	resp.Body = body
+	c.responseBody.Store(body)
+}
+
+// responseBodySize returns the bytes read from the body of the last response of the call, when it was counted
+func (c *backendCall) responseBodySize() (int64, bool) {
+	body, ok := c.responseBody.Load().(*countingReadCloser)
+	if !ok {
+		return 0, false
+	}
+	return body.count(), true
+}
+
+func contextWithBackendCall(ctx context.Context, urlPattern string) (context.Context, *backendCall) {
+	call := &backendCall{urlPattern: urlPattern}
+	return context.WithValue(ctx, backendCallKey{}, call), call
+}
+
+func backendCallFromContext(ctx context.Context) *backendCall {
+	call, _ := ctx.Value(backendCallKey{}).(*backendCall)
+	return call
+}
+
+// CacheHTTPClientFactory wraps the http client factory of the backends, usually the one of the httpcache module,
+// so the responses served from the cache are detected even when the response headers are not kept by the gateway.
+func CacheHTTPClientFactory(next client.HTTPClientFactory) client.HTTPClientFactory {
+	return func(ctx context.Context) *http.Client {
+		c := *next(ctx)
+		transport := c.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		c.Transport = cacheRoundTripper{next: transport}
+		return &c
+	}
+}
+
+type cacheRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (t cacheRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.Header.Get(fromCacheHeader) != "" {
+		if call := backendCallFromContext(req.Context()); call != nil {
+			call.markCacheHit()
+		}
+	}
+	return resp, err
+}
+
+// recordCacheStatus adds the cache.hit attribute to the segment of the backend call. When the segments are enabled,
+// the external segments of the responses served from the cache are named External/{host}/cache/{method}.
+// When the metrics are enabled, 1 is recorded for a hit and 0 for a miss, so the average is the hit ratio.
+func recordCacheStatus(
+	segment interface{},
+	call *backendCall,
+	resp *proxy.Response,
+	host, urlPattern string,
+) {
+	hit := call.servedFromCache() || http.Header(resp.Metadata.Headers).Get(fromCacheHeader) != ""
+
+	if s, ok := segment.(AttributeAdder); ok {
+		s.AddAttribute("cache.hit", hit)
+	}
+	if hit && app.Config.Cache.Segments {
+		if s, ok := segment.(externalSegmentLibrarySetter); ok {
+			s.setLibrary(cacheLibrary)
+		}
+	}
+	if app.Config.Cache.Metrics {
+		value := 0.0
+		if hit {
+			value = 1
+		}
+		app.RecordCustomMetric(cacheHitMetric+host+urlPattern, value)
+	}
+}
@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/encoding"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// fakeCacheTransport responds like the httpcache transport, flagging the responses served from the cache
+func fakeCacheTransport(fromCache bool) http.RoundTripper {
+	return roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			if fromCache {
+				header.Set(fromCacheHeader, "1")
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     header,
+				Body:       ioutil.NopCloser(strings.NewReader(`{"id":"gopher"}`)),
+				Request:    req,
+			}, nil
+		},
+	)
+}
+
+func TestBackendFactory_cache(t *testing.T) {
+	tests := []struct {
+		name            string
+		conf            CacheConfig
+		fromCache       bool
+		wantSegmentName string
+		wantAttributes  map[string]interface{}
+		wantMetrics     []float64
+	}{
+		{
+			name:            "given the cache instrumentation is disabled, it should not record the cache status",
+			conf:            CacheConfig{},
+			fromCache:       true,
+			wantSegmentName: "External/backend:8080/http/GET",
+			wantAttributes:  map[string]interface{}{},
+			wantMetrics:     []float64{},
+		},
+		{
+			name:            "given a response served from the cache, it should record the hit",
+			conf:            CacheConfig{Enabled: true},
+			fromCache:       true,
+			wantSegmentName: "External/backend:8080/http/GET",
+			wantAttributes:  map[string]interface{}{"cache.hit": true},
+			wantMetrics:     []float64{},
+		},
+		{
+			name:            "given a response not served from the cache, it should record the miss",
+			conf:            CacheConfig{Enabled: true, Segments: true, Metrics: true},
+			fromCache:       false,
+			wantSegmentName: "External/backend:8080/http/GET",
+			wantAttributes:  map[string]interface{}{"cache.hit": false},
+			wantMetrics:     []float64{0},
+		},
+		{
+			name:            "given the cache segments and metrics are enabled, it should record the hit distinctly",
+			conf:            CacheConfig{Enabled: true, Segments: true, Metrics: true},
+			fromCache:       true,
+			wantSegmentName: "External/backend:8080/cache/GET",
+			wantAttributes:  map[string]interface{}{"cache.hit": true},
+			wantMetrics:     []float64{1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				recorder := NewRecorder()
+				app = &Application{
+					TransactionManager: recorder,
+					NRApplication:      recorder,
+					Config:             Config{InstrumentationRate: 100, Cache: tt.conf},
+				}
+				defer func() { app = nil }()
+
+				clientFactory := CacheHTTPClientFactory(
+					func(ctx context.Context) *http.Client {
+						return &http.Client{Transport: fakeCacheTransport(tt.fromCache)}
+					},
+				)
+				bf := BackendFactory("backend", proxy.CustomHTTPProxyFactory(clientFactory))
+				p := bf(&config.Backend{URLPattern: "/users/{id}", Decoder: encoding.JSONDecoder})
+
+				ctx, txn := recorder.StartTransactionContext(context.Background(), "/users")
+				backendURL, _ := url.Parse("http://backend:8080/users/1")
+				resp, err := p(ctx, &proxy.Request{Method: http.MethodGet, URL: backendURL, Headers: map[string][]string{}})
+				txn.End()
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, "gopher", resp.Data["id"])
+
+				recorded, _ := recorder.Transaction("/users")
+				if !assert.Len(t, recorded.Segments, 1) {
+					return
+				}
+				assert.Equal(t, tt.wantSegmentName, recorded.Segments[0].Name)
+				assert.Equal(t, tt.wantAttributes, recorded.Segments[0].Attributes)
+				assert.Equal(t, tt.wantMetrics, recorder.Metrics("Custom/KrakenD/CacheHit/backend:8080/users/{id}"))
+			},
+		)
+	}
+}
+
+func TestNewBackend_cacheHeader(t *testing.T) {
+	recorder := NewRecorder()
+	app = &Application{
+		TransactionManager: recorder,
+		NRApplication:      recorder,
+		Config:             Config{InstrumentationRate: 100, Cache: CacheConfig{Enabled: true}},
+	}
+	defer func() { app = nil }()
+
+	p := NewBackend(
+		"backend", func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{
+				Metadata: proxy.Metadata{
+					StatusCode: http.StatusOK,
+					Headers:    map[string][]string{fromCacheHeader: {"1"}},
+				},
+			}, nil
+		},
+	)
+
+	ctx, txn := recorder.StartTransactionContext(context.Background(), "/users")
+	backendURL, _ := url.Parse("http://backend:8080/users/1")
+	_, err := p(ctx, &proxy.Request{Method: http.MethodGet, URL: backendURL, Headers: map[string][]string{}})
+	txn.End()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	recorded, _ := recorder.Transaction("/users")
+	if assert.Len(t, recorded.Segments, 1) {
+		assert.Equal(t, true, recorded.Segments[0].Attributes["cache.hit"])
+	}
+}
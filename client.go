@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	clientIDKey     = "krakendNewRelicClientID"
+	clientSourceKey = "krakendNewRelicClientSource"
+
+	clientMetric = "Custom/KrakenD/Client/"
+	// otherClients replaces the identifier of the clients not listed in the metrics_clients in the metric names
+	otherClients = "Other"
+
+	// ClientSourceHeader identifies the client from a header
+	ClientSourceHeader = "header"
+	// ClientSourceClaim identifies the client from a claim of the JWT
+	ClientSourceClaim = "claim"
+	// ClientSourceAPIKey identifies the client from the hash of its API key
+	ClientSourceAPIKey = "api_key"
+)
+
+// ClientConfig configures how the client of a request is identified.
+// The header, the claim and the API key are tried in this order.
+type ClientConfig struct {
+	Header       string `json:"header"`
+	Claim        string `json:"claim"`
+	APIKeyHeader string `json:"api_key_header"`
+	Metrics      bool   `json:"metrics"`
+	// MetricsClients are the clients with their own metrics, the others sharing the Other metrics
+	MetricsClients []string `json:"metrics_clients"`
+}
+
+func (c ClientConfig) enabled() bool {
+	return c.Header != "" || c.Claim != "" || c.APIKeyHeader != ""
+}
+
+// ClientID returns the identifier of the client of the request, empty when it is not identified
+func ClientID(ctx context.Context) string {
+	id, _ := ctx.Value(clientIDKey).(string)
+	return id
+}
+
+// identifyClient returns the identifier of the client from the header or the API key, and where it comes from.
+// The claim is only read once the token is validated, by identifyClaimClient.
+func identifyClient(c *gin.Context, conf ClientConfig) (string, string) {
+	if conf.Header != "" {
+		if id := strings.TrimSpace(c.GetHeader(conf.Header)); id != "" {
+			return id, ClientSourceHeader
+		}
+	}
+	if conf.APIKeyHeader != "" {
+		if key := strings.TrimSpace(c.GetHeader(conf.APIKeyHeader)); key != "" {
+			return hashValue(app.hashKey, key), ClientSourceAPIKey
+		}
+	}
+	return "", ""
+}
+
+// identifyClaimClient identifies the client from the claim of the token once the authentication succeeded,
+// unless it was identified from the header
+func identifyClaimClient(txn Transaction, c *gin.Context) {
+	conf := app.Config.Client
+	if conf.Claim == "" || c.GetString(clientSourceKey) == ClientSourceHeader {
+		return
+	}
+	claims, err := tokenClaims(c.Request, app.Config.Auth.Header, app.Config.Auth.Cookie)
+	if err != nil {
+		return
+	}
+	if id, ok := claimValue(claims, conf.Claim); ok && id != "" {
+		c.Set(clientIDKey, id)
+		c.Set(clientSourceKey, ClientSourceClaim)
+		addClientAttributes(txn, c)
+	}
+}
+
+// clientMW identifies the client before the next middleware and, when enabled, records the
+// Custom/KrakenD/Client/{id}/Requests and Custom/KrakenD/Client/{id}/Errors metrics once the request is served.
+// Only the metrics_clients get their own metrics, the others are recorded as Other, so the number of metrics is
+// bounded whatever the identifiers sent by the clients.
+// The errors metric is 1 for an error and 0 otherwise, so its average is the error rate.
+func clientMW(next gin.HandlerFunc) gin.HandlerFunc {
+	conf := app.Config.Client
+	if !conf.enabled() {
+		return next
+	}
+
+	classification := app.Config.StatusCodes
+	if classification == nil {
+		classification = &StatusCodeClassification{}
+	}
+	metricsClients := make(map[string]bool, len(conf.MetricsClients))
+	for _, id := range conf.MetricsClients {
+		metricsClients[id] = true
+	}
+	return func(c *gin.Context) {
+		if id, source := identifyClient(c, conf); id != "" {
+			c.Set(clientIDKey, id)
+			c.Set(clientSourceKey, source)
+		}
+		next(c)
+
+		id := c.GetString(clientIDKey)
+		if !conf.Metrics || id == "" {
+			return
+		}
+		if !metricsClients[id] {
+			id = otherClients
+		}
+		failed := 0.0
+		if classification.classify(c.Writer.Status()) == statusCodeError {
+			failed = 1
+		}
+		app.RecordCustomMetric(clientMetric+id+"/Requests", 1)
+		app.RecordCustomMetric(clientMetric+id+"/Errors", failed)
+	}
+}
+
+// addClientAttributes adds the client of the request to the transaction
+func addClientAttributes(txn Transaction, c *gin.Context) {
+	id := c.GetString(clientIDKey)
+	if id == "" {
+		return
+	}
+	addAttribute(txn, "client.id", id)
+	addAttribute(txn, "client.source", c.GetString(clientSourceKey))
+}
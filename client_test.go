@@ -0,0 +1,198 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware_client(t *testing.T) {
+	tests := []struct {
+		name           string
+		conf           ClientConfig
+		authenticated  bool
+		headers        map[string]string
+		status         int
+		wantAttributes map[string]interface{}
+		wantMetrics    map[string][]float64
+	}{
+		{
+			name:           "given no client identification, it should not identify the client",
+			headers:        map[string]string{"X-Client-Id": "acme"},
+			status:         http.StatusOK,
+			wantAttributes: map[string]interface{}{},
+		},
+		{
+			name:    "given a client header, it should identify the client from it",
+			conf:    ClientConfig{Header: "X-Client-Id", Claim: "azp"},
+			headers: map[string]string{"X-Client-Id": "acme", "Authorization": "Bearer " + testToken(`{"azp":"other"}`)},
+			status:  http.StatusOK,
+			wantAttributes: map[string]interface{}{
+				"client.id":     "acme",
+				"client.source": ClientSourceHeader,
+			},
+		},
+		{
+			name:          "given a client claim, it should identify the client from the validated token",
+			conf:          ClientConfig{Header: "X-Client-Id", Claim: "azp"},
+			authenticated: true,
+			headers:       map[string]string{"Authorization": "Bearer " + testToken(`{"azp":"acme"}`)},
+			status:        http.StatusOK,
+			wantAttributes: map[string]interface{}{
+				"client.id":     "acme",
+				"client.source": ClientSourceClaim,
+			},
+		},
+		{
+			name:           "given a client claim of a token not validated, it should not identify the client",
+			conf:           ClientConfig{Claim: "azp"},
+			headers:        map[string]string{"Authorization": "Bearer " + testToken(`{"azp":"acme"}`)},
+			status:         http.StatusOK,
+			wantAttributes: map[string]interface{}{},
+		},
+		{
+			name:          "given an API key and a client claim, it should identify the client from the validated token",
+			conf:          ClientConfig{Claim: "azp", APIKeyHeader: "X-Api-Key"},
+			authenticated: true,
+			headers: map[string]string{
+				"Authorization": "Bearer " + testToken(`{"azp":"acme"}`),
+				"X-Api-Key":     "secret-key",
+			},
+			status: http.StatusOK,
+			wantAttributes: map[string]interface{}{
+				"client.id":     "acme",
+				"client.source": ClientSourceClaim,
+			},
+		},
+		{
+			name:    "given an API key, it should identify the client from its hash",
+			conf:    ClientConfig{APIKeyHeader: "X-Api-Key"},
+			headers: map[string]string{"X-Api-Key": "secret-key"},
+			status:  http.StatusOK,
+			wantAttributes: map[string]interface{}{
+				"client.id":     hashValue([]byte("hash-key"), "secret-key"),
+				"client.source": ClientSourceAPIKey,
+			},
+		},
+		{
+			name:    "given the client metrics are enabled, it should record the requests and the errors",
+			conf:    ClientConfig{Header: "X-Client-Id", Metrics: true, MetricsClients: []string{"acme"}},
+			headers: map[string]string{"X-Client-Id": "acme"},
+			status:  http.StatusInternalServerError,
+			wantAttributes: map[string]interface{}{
+				"client.id":     "acme",
+				"client.source": ClientSourceHeader,
+			},
+			wantMetrics: map[string][]float64{
+				"Custom/KrakenD/Client/acme/Requests": {1},
+				"Custom/KrakenD/Client/acme/Errors":   {1},
+			},
+		},
+		{
+			name:    "given a successful request, it should record no error",
+			conf:    ClientConfig{Header: "X-Client-Id", Metrics: true, MetricsClients: []string{"acme"}},
+			headers: map[string]string{"X-Client-Id": "acme"},
+			status:  http.StatusOK,
+			wantAttributes: map[string]interface{}{
+				"client.id":     "acme",
+				"client.source": ClientSourceHeader,
+			},
+			wantMetrics: map[string][]float64{
+				"Custom/KrakenD/Client/acme/Requests": {1},
+				"Custom/KrakenD/Client/acme/Errors":   {0},
+			},
+		},
+		{
+			name:    "given a client not listed in the metrics clients, it should record the requests as other",
+			conf:    ClientConfig{Header: "X-Client-Id", Metrics: true, MetricsClients: []string{"acme"}},
+			headers: map[string]string{"X-Client-Id": "unknown"},
+			status:  http.StatusOK,
+			wantAttributes: map[string]interface{}{
+				"client.id":     "unknown",
+				"client.source": ClientSourceHeader,
+			},
+			wantMetrics: map[string][]float64{
+				"Custom/KrakenD/Client/unknown/Requests": {},
+				"Custom/KrakenD/Client/Other/Requests":   {1},
+				"Custom/KrakenD/Client/Other/Errors":     {0},
+			},
+		},
+		{
+			name:          "given a client identified from a validated token, it should record its metrics",
+			conf:          ClientConfig{Claim: "azp", Metrics: true, MetricsClients: []string{"acme"}},
+			authenticated: true,
+			headers:       map[string]string{"Authorization": "Bearer " + testToken(`{"azp":"acme"}`)},
+			status:        http.StatusOK,
+			wantAttributes: map[string]interface{}{
+				"client.id":     "acme",
+				"client.source": ClientSourceClaim,
+			},
+			wantMetrics: map[string][]float64{
+				"Custom/KrakenD/Client/acme/Requests": {1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				recorder := NewRecorder()
+				app = &Application{
+					TransactionManager: recorder,
+					NRApplication:      recorder,
+					Config:             Config{InstrumentationRate: 100, Client: tt.conf},
+					hashKey:            []byte("hash-key"),
+				}
+				defer func() { app = nil }()
+
+				handlerFactory := HandlerFactory(
+					func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+						return func(c *gin.Context) {
+							assert.Equal(t, tt.wantAttributes["client.id"], nilIfEmpty(ClientID(c)))
+							c.Status(tt.status)
+						}
+					},
+				)
+				if tt.authenticated {
+					handlerFactory = AuthHandlerFactory("auth", fakeValidator, handlerFactory)
+				}
+				handler := handlerFactory(&config.EndpointConfig{Method: http.MethodGet, Endpoint: "/users"}, nil)
+
+				gin.SetMode(gin.TestMode)
+				e := gin.New()
+				e.Use(Middleware())
+				e.GET("/users", handler)
+				req := httptest.NewRequest(http.MethodGet, "/users", nil)
+				for k, v := range tt.headers {
+					req.Header.Set(k, v)
+				}
+				e.ServeHTTP(httptest.NewRecorder(), req)
+
+				txn, ok := recorder.Transaction("/users")
+				if !assert.True(t, ok) {
+					return
+				}
+				for k, v := range tt.wantAttributes {
+					assert.Equal(t, v, txn.Attributes[k], k)
+				}
+				if len(tt.wantAttributes) == 0 {
+					assert.NotContains(t, txn.Attributes, "client.id")
+				}
+				for name, values := range tt.wantMetrics {
+					assert.Equal(t, values, recorder.Metrics(name), name)
+				}
+			},
+		)
+	}
+}
+
+func nilIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
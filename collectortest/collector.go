@@ -0,0 +1,234 @@
+// Package collectortest provides a fake NewRelic collector, so the data sent by the NewRelic Go agent
+// can be asserted in end-to-end tests without a NewRelic account.
+package collectortest
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+const (
+	// RunID is the agent run id returned by the collector on connect.
+	RunID = "krakend-collectortest-run"
+	// AccountID is the account id returned by the collector on connect.
+	AccountID = "12345"
+	// AppID is the application id returned by the collector on connect.
+	AppID = "67890"
+
+	license = "0000000000000000000000000000000000000000"
+	appName = "krakend-collectortest"
+)
+
+// Event is an event sent by the agent, e.g. a transaction event, a span event or a custom event.
+type Event struct {
+	Intrinsics      map[string]interface{}
+	UserAttributes  map[string]interface{}
+	AgentAttributes map[string]interface{}
+}
+
+// TracedError is an error trace sent by the agent.
+type TracedError struct {
+	TransactionName string
+	Message         string
+	Class           string
+	Attributes      map[string]interface{}
+}
+
+// Collector is a fake NewRelic collector implementing enough of the collector protocol for the agent
+// to connect and harvest its data.
+type Collector struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	payloads map[string][]json.RawMessage
+}
+
+// NewCollector starts a fake collector. It must be closed with Close.
+func NewCollector() *Collector {
+	c := &Collector{
+		payloads: map[string][]json.RawMessage{},
+	}
+	c.server = httptest.NewTLSServer(http.HandlerFunc(c.serveHTTP))
+
+	return c
+}
+
+// ConfigOption points the agent at the collector.
+// The license and the application name are set when they are not configured yet.
+func (c *Collector) ConfigOption() newrelic.ConfigOption {
+	return func(cfg *newrelic.Config) {
+		cfg.Host = strings.TrimPrefix(c.server.URL, "https://")
+		cfg.Transport = c.server.Client().Transport
+		if len(cfg.License) != len(license) {
+			cfg.License = license
+		}
+		if cfg.AppName == "" {
+			cfg.AppName = appName
+		}
+	}
+}
+
+// Close shuts the collector down.
+func (c *Collector) Close() {
+	c.server.Close()
+}
+
+// Payloads returns the decoded payloads received for the collector method, e.g. analytic_event_data.
+func (c *Collector) Payloads(method string) []json.RawMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]json.RawMessage(nil), c.payloads[method]...)
+}
+
+// TransactionEvents returns the transaction events received.
+func (c *Collector) TransactionEvents() ([]Event, error) {
+	return c.events("analytic_event_data")
+}
+
+// SpanEvents returns the span events received.
+func (c *Collector) SpanEvents() ([]Event, error) {
+	return c.events("span_event_data")
+}
+
+// CustomEvents returns the custom events received.
+func (c *Collector) CustomEvents() ([]Event, error) {
+	return c.events("custom_event_data")
+}
+
+// Errors returns the error traces received.
+func (c *Collector) Errors() ([]TracedError, error) {
+	var result []TracedError
+	for _, payload := range c.Payloads("error_data") {
+		// [runID, [[timestamp, transactionName, message, class, attributes], ...]]
+		var data []json.RawMessage
+		if err := json.Unmarshal(payload, &data); err != nil {
+			return nil, err
+		}
+		if len(data) != 2 {
+			return nil, fmt.Errorf("unexpected error_data payload: %s", payload)
+		}
+		var traces [][]json.RawMessage
+		if err := json.Unmarshal(data[1], &traces); err != nil {
+			return nil, err
+		}
+		for _, trace := range traces {
+			if len(trace) < 5 {
+				return nil, fmt.Errorf("unexpected error trace: %s", payload)
+			}
+			var tracedErr TracedError
+			if err := unmarshalAll(
+				[]json.RawMessage{trace[1], trace[2], trace[3], trace[4]},
+				&tracedErr.TransactionName, &tracedErr.Message, &tracedErr.Class, &tracedErr.Attributes,
+			); err != nil {
+				return nil, err
+			}
+			result = append(result, tracedErr)
+		}
+	}
+
+	return result, nil
+}
+
+func (c *Collector) events(method string) ([]Event, error) {
+	var result []Event
+	for _, payload := range c.Payloads(method) {
+		// [runID, {"reservoir_size": n, "events_seen": n}, [[intrinsics, user, agent], ...]]
+		var data []json.RawMessage
+		if err := json.Unmarshal(payload, &data); err != nil {
+			return nil, err
+		}
+		if len(data) != 3 {
+			return nil, fmt.Errorf("unexpected %s payload: %s", method, payload)
+		}
+		var events [][]json.RawMessage
+		if err := json.Unmarshal(data[2], &events); err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			if len(event) != 3 {
+				return nil, fmt.Errorf("unexpected %s event: %s", method, payload)
+			}
+			var e Event
+			if err := unmarshalAll(event, &e.Intrinsics, &e.UserAttributes, &e.AgentAttributes); err != nil {
+				return nil, err
+			}
+			result = append(result, e)
+		}
+	}
+
+	return result, nil
+}
+
+func (c *Collector) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Query().Get("method")
+
+	body, err := readBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	c.payloads[method] = append(c.payloads[method], body)
+	c.mu.Unlock()
+
+	var reply interface{}
+	switch method {
+	case "preconnect":
+		reply = map[string]interface{}{
+			"redirect_host": r.Host,
+		}
+	case "connect":
+		reply = map[string]interface{}{
+			"agent_run_id":             RunID,
+			"entity_guid":              "krakend-collectortest-entity",
+			"account_id":               AccountID,
+			"trusted_account_key":      AccountID,
+			"primary_application_id":   AppID,
+			"sampling_target":          1000,
+			"collect_analytics_events": true,
+			"collect_custom_events":    true,
+			"collect_traces":           true,
+			"collect_errors":           true,
+			"collect_error_events":     true,
+			"collect_span_events":      true,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"return_value": reply})
+}
+
+func readBody(r *http.Request) ([]byte, error) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	return ioutil.ReadAll(body)
+}
+
+func unmarshalAll(data []json.RawMessage, values ...interface{}) error {
+	for i, v := range values {
+		if err := json.Unmarshal(data[i], v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
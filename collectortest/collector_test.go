@@ -0,0 +1,64 @@
+package collectortest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollector(t *testing.T) {
+	collector := NewCollector()
+	defer collector.Close()
+
+	app, err := newrelic.NewApplication(
+		newrelic.ConfigAppName("collector"),
+		newrelic.ConfigDistributedTracerEnabled(true),
+		collector.ConfigOption(),
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, app.WaitForConnection(5*time.Second)) {
+		return
+	}
+
+	txn := app.StartTransaction("/users")
+	txn.AddAttribute("user", "gopher")
+	txn.NoticeError(errors.New("boom"))
+	txn.StartSegment("segment").End()
+	txn.End()
+	app.RecordCustomEvent("KrakendEvent", map[string]interface{}{"key": "value"})
+	app.Shutdown(5 * time.Second)
+
+	assert.Len(t, collector.Payloads("preconnect"), 1)
+	assert.Len(t, collector.Payloads("connect"), 1)
+
+	txnEvents, err := collector.TransactionEvents()
+	if assert.NoError(t, err) && assert.Len(t, txnEvents, 1) {
+		assert.Equal(t, "OtherTransaction/Go/users", txnEvents[0].Intrinsics["name"])
+		assert.Equal(t, "gopher", txnEvents[0].UserAttributes["user"])
+		assert.Equal(t, true, txnEvents[0].Intrinsics["error"])
+	}
+
+	spanEvents, err := collector.SpanEvents()
+	if assert.NoError(t, err) && assert.Len(t, spanEvents, 2) {
+		names := []interface{}{spanEvents[0].Intrinsics["name"], spanEvents[1].Intrinsics["name"]}
+		assert.ElementsMatch(t, []interface{}{"OtherTransaction/Go/users", "Custom/segment"}, names)
+	}
+
+	customEvents, err := collector.CustomEvents()
+	if assert.NoError(t, err) && assert.Len(t, customEvents, 1) {
+		assert.Equal(t, "KrakendEvent", customEvents[0].Intrinsics["type"])
+		assert.Equal(t, "value", customEvents[0].UserAttributes["key"])
+	}
+
+	tracedErrors, err := collector.Errors()
+	if assert.NoError(t, err) && assert.Len(t, tracedErrors, 1) {
+		assert.Equal(t, "OtherTransaction/Go/users", tracedErrors[0].TransactionName)
+		assert.Equal(t, "boom", tracedErrors[0].Message)
+		assert.Equal(t, "*errors.errorString", tracedErrors[0].Class)
+	}
+}
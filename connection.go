@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/logging"
+)
+
+const (
+	// ConnectionWaitBlock waits for the connection when registering, then keeps retrying in the background
+	ConnectionWaitBlock = "block"
+	// ConnectionWaitNone does not wait for the connection when registering, it is retried in the background
+	ConnectionWaitNone = "none"
+	// ConnectionWaitFail waits for the connection when registering and fails when it is not established
+	ConnectionWaitFail = "fail"
+
+	defaultConnectionTimeout       = 5 * time.Second
+	defaultConnectionRetryInterval = 10 * time.Second
+)
+
+// ConnectionConfig configures how the application waits for the agent connection
+type ConnectionConfig struct {
+	Wait          string `json:"wait"`
+	Timeout       string `json:"timeout"`
+	RetryInterval string `json:"retry_interval"`
+}
+
+// ConnectionStatus is the status of the agent connection.
+// Connected is queried from the agent, the other fields describe the connection attempts.
+type ConnectionStatus struct {
+	Connected   bool      `json:"connected"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+type connectionState struct {
+	mu     sync.RWMutex
+	status ConnectionStatus
+}
+
+func (s *connectionState) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.Attempts++
+	if err != nil {
+		s.status.LastError = err.Error()
+		return
+	}
+	s.status.LastError = ""
+	s.status.ConnectedAt = time.Now()
+}
+
+func (s *connectionState) get() ConnectionStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.status
+}
+
+// parseConnectionConfig validates the connection config and returns its timeout and retry interval,
+// zero when they are not configured
+func parseConnectionConfig(conf ConnectionConfig) (time.Duration, time.Duration, error) {
+	switch conf.Wait {
+	case "", ConnectionWaitBlock, ConnectionWaitNone, ConnectionWaitFail:
+	default:
+		return 0, 0, fmt.Errorf("unknown connection wait %s", conf.Wait)
+	}
+
+	var timeout, retryInterval time.Duration
+	var err error
+	if conf.Timeout != "" {
+		if timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+			return 0, 0, fmt.Errorf("invalid connection timeout: %w", err)
+		}
+	}
+	if conf.RetryInterval != "" {
+		if retryInterval, err = time.ParseDuration(conf.RetryInterval); err != nil {
+			return 0, 0, fmt.Errorf("invalid connection retry_interval: %w", err)
+		}
+	}
+
+	return timeout, retryInterval, nil
+}
+
+// Connect waits for the agent connection according to the connection config.
+// Unless the connection wait is fail, the connection is retried in the background until the context is done.
+func (a *Application) Connect(ctx context.Context, logger logging.Logger) error {
+	if a.Config.Connection.Wait == ConnectionWaitNone {
+		go a.retryConnection(ctx, logger)
+		return nil
+	}
+
+	err := a.waitForConnection()
+	if err == nil {
+		return nil
+	}
+	if a.Config.Connection.Wait == ConnectionWaitFail {
+		return fmt.Errorf("unable to connect the NR module: %w", err)
+	}
+
+	logger.Error("error initializing metrics collector", err.Error())
+	go a.retryConnection(ctx, logger)
+
+	return nil
+}
+
+// ConnectionStatus returns the status of the agent connection.
+// The agent reconnects on its own, so it is asked whether it is currently connected, reporting the later
+// disconnections too.
+func (a *Application) ConnectionStatus() ConnectionStatus {
+	status := a.connection.get()
+	status.Connected = a.NRApplication != nil && a.WaitForConnection(0) == nil
+	return status
+}
+
+// Connected tells whether the agent is currently connected
+func (a *Application) Connected() bool {
+	return a.ConnectionStatus().Connected
+}
+
+func (a *Application) waitForConnection() error {
+	timeout := a.connectionTimeout
+	if timeout == 0 {
+		timeout = defaultConnectionTimeout
+	}
+
+	err := a.WaitForConnection(timeout)
+	a.connection.record(err)
+
+	return err
+}
+
+// retryConnection polls the agent, which connects on its own, to log when it is connected and record the attempts
+func (a *Application) retryConnection(ctx context.Context, logger logging.Logger) {
+	retryInterval := a.connectionRetryInterval
+	if retryInterval == 0 {
+		retryInterval = defaultConnectionRetryInterval
+	}
+
+	for {
+		if err := a.waitForConnection(); err == nil {
+			logger.Info("metrics collector connected")
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// Ready tells whether the agent of the registered application is connected
+func Ready() bool {
+	return app != nil && app.Connected()
+}
+
+// ReadinessHandler responds with the connection status of the registered application,
+// with a 503 status code until the agent is connected
+func ReadinessHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if app == nil {
+			c.JSON(http.StatusServiceUnavailable, ConnectionStatus{})
+			return
+		}
+
+		status := app.ConnectionStatus()
+		if !status.Connected {
+			c.JSON(http.StatusServiceUnavailable, status)
+			return
+		}
+		c.JSON(http.StatusOK, status)
+	}
+}
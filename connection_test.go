@@ -0,0 +1,214 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplication_Connect(t *testing.T) {
+	connectionErr := errors.New("timeout")
+	tests := []struct {
+		name          string
+		wait          string
+		waitResults   []error
+		disconnected  bool
+		wantErr       assert.ErrorAssertionFunc
+		wantConnected bool
+		wantAttempts  int
+	}{
+		{
+			name:          "given the agent connects, it should be connected",
+			waitResults:   []error{nil},
+			wantErr:       assert.NoError,
+			wantConnected: true,
+			wantAttempts:  1,
+		},
+		{
+			name:          "given the agent connects after a retry, it should be connected in the background",
+			wait:          ConnectionWaitBlock,
+			waitResults:   []error{connectionErr, nil},
+			wantErr:       assert.NoError,
+			wantConnected: true,
+			wantAttempts:  2,
+		},
+		{
+			name:          "given the none connection wait, it should connect in the background",
+			wait:          ConnectionWaitNone,
+			waitResults:   []error{connectionErr, connectionErr, nil},
+			wantErr:       assert.NoError,
+			wantConnected: true,
+			wantAttempts:  3,
+		},
+		{
+			name:          "given the agent disconnects after connecting, it should not be connected",
+			waitResults:   []error{nil},
+			disconnected:  true,
+			wantErr:       assert.NoError,
+			wantConnected: false,
+			wantAttempts:  1,
+		},
+		{
+			name:          "given the fail connection wait and the agent does not connect, it should return an error",
+			wait:          ConnectionWaitFail,
+			waitResults:   []error{connectionErr},
+			wantErr:       assert.Error,
+			wantConnected: false,
+			wantAttempts:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				ctrl := gomock.NewController(t)
+				nrApp := NewMockNRApplication(ctrl)
+				var calls []*gomock.Call
+				for _, result := range tt.waitResults {
+					calls = append(calls, nrApp.EXPECT().WaitForConnection(time.Millisecond).Return(result))
+				}
+				gomock.InOrder(calls...)
+				var current error
+				if !tt.wantConnected || tt.disconnected {
+					current = connectionErr
+				}
+				nrApp.EXPECT().WaitForConnection(time.Duration(0)).Return(current).AnyTimes()
+
+				a := &Application{
+					NRApplication:           nrApp,
+					Config:                  Config{Connection: ConnectionConfig{Wait: tt.wait}},
+					connectionTimeout:       time.Millisecond,
+					connectionRetryInterval: time.Millisecond,
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				if !tt.wantErr(t, a.Connect(ctx, logging.NoOp)) {
+					return
+				}
+				assert.Eventually(
+					t, func() bool {
+						return a.ConnectionStatus().Attempts == tt.wantAttempts
+					}, time.Second, time.Millisecond,
+				)
+				assert.Equal(t, tt.wantConnected, a.Connected())
+			},
+		)
+	}
+}
+
+func Test_parseConnectionConfig(t *testing.T) {
+	tests := []struct {
+		name              string
+		conf              ConnectionConfig
+		wantTimeout       time.Duration
+		wantRetryInterval time.Duration
+		wantErr           assert.ErrorAssertionFunc
+	}{
+		{
+			name:    "given no config, it should return zero durations",
+			conf:    ConnectionConfig{},
+			wantErr: assert.NoError,
+		},
+		{
+			name:              "given durations, it should parse them",
+			conf:              ConnectionConfig{Wait: ConnectionWaitNone, Timeout: "1s", RetryInterval: "1m"},
+			wantTimeout:       time.Second,
+			wantRetryInterval: time.Minute,
+			wantErr:           assert.NoError,
+		},
+		{
+			name:    "given an unknown wait, it should return an error",
+			conf:    ConnectionConfig{Wait: "sometimes"},
+			wantErr: assert.Error,
+		},
+		{
+			name:    "given an invalid timeout, it should return an error",
+			conf:    ConnectionConfig{Timeout: "soon"},
+			wantErr: assert.Error,
+		},
+		{
+			name:    "given an invalid retry interval, it should return an error",
+			conf:    ConnectionConfig{RetryInterval: "often"},
+			wantErr: assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				timeout, retryInterval, err := parseConnectionConfig(tt.conf)
+				if !tt.wantErr(t, err) {
+					return
+				}
+				assert.Equal(t, tt.wantTimeout, timeout)
+				assert.Equal(t, tt.wantRetryInterval, retryInterval)
+			},
+		)
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	nrApp := func(current error) NRApplication {
+		nrApp := NewMockNRApplication(ctrl)
+		nrApp.EXPECT().WaitForConnection(time.Duration(0)).Return(current).AnyTimes()
+		return nrApp
+	}
+	tests := []struct {
+		name       string
+		app        *Application
+		wantStatus int
+		wantReady  bool
+	}{
+		{
+			name:       "given no application, it should not be ready",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "given the agent is not connected, it should not be ready",
+			app:        &Application{},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name: "given the agent is connected, it should be ready",
+			app: &Application{
+				NRApplication: nrApp(nil),
+				connection:    connectionState{status: ConnectionStatus{Attempts: 1}},
+			},
+			wantStatus: http.StatusOK,
+			wantReady:  true,
+		},
+		{
+			name: "given the agent disconnected after connecting, it should not be ready",
+			app: &Application{
+				NRApplication: nrApp(errors.New("timeout")),
+				connection:    connectionState{status: ConnectionStatus{Attempts: 1}},
+			},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				app = tt.app
+				defer func() { app = nil }()
+
+				gin.SetMode(gin.TestMode)
+				w := httptest.NewRecorder()
+				_, e := gin.CreateTestContext(w)
+				e.GET("/ready", ReadinessHandler())
+				e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+
+				assert.Equal(t, tt.wantStatus, w.Code)
+				assert.Equal(t, tt.wantReady, Ready())
+			},
+		)
+	}
+}
@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+const (
+	// ExporterDebug logs the data with the lura logger instead of sending it
+	ExporterDebug = "debug"
+
+	// DebugFormatText logs the data in a readable form
+	DebugFormatText = "text"
+	// DebugFormatJSON logs the data as JSON
+	DebugFormatJSON = "json"
+
+	debugLogPrefix = "[SERVICE: NewRelic]"
+)
+
+// DebugConfig configures the debug exporter used when the exporter is debug
+type DebugConfig struct {
+	Format string `json:"format"`
+}
+
+// DebugExporter implements NRApplication and TransactionManager by logging the transactions, segments,
+// attributes, custom events, custom metrics and logs that would be sent to NewRelic.
+// Ignored transactions are not logged.
+type DebugExporter struct {
+	*Recorder
+	logger logging.Logger
+	format string
+}
+
+type debugTransaction struct {
+	Name       string                 `json:"name"`
+	TraceID    string                 `json:"traceId"`
+	StatusCode int                    `json:"statusCode,omitempty"`
+	DurationMs float64                `json:"durationMs"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Errors     []string               `json:"errors,omitempty"`
+	Segments   []debugSegment         `json:"segments,omitempty"`
+}
+
+type debugSegment struct {
+	Name       string                 `json:"name"`
+	URL        string                 `json:"url,omitempty"`
+	Procedure  string                 `json:"procedure,omitempty"`
+	StatusCode int                    `json:"statusCode,omitempty"`
+	DurationMs float64                `json:"durationMs"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// NewDebugExporter creates a DebugExporter logging in the format, text by default
+func NewDebugExporter(logger logging.Logger, format string) (*DebugExporter, error) {
+	switch format {
+	case "":
+		format = DebugFormatText
+	case DebugFormatText, DebugFormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown debug format %s", format)
+	}
+
+	e := &DebugExporter{
+		Recorder: NewRecorder(),
+		logger:   logger,
+		format:   format,
+	}
+	e.Recorder.onTransactionEnd = e.logTransaction
+
+	return e, nil
+}
+
+func (e *DebugExporter) RecordCustomEvent(eventType string, params map[string]interface{}) {
+	e.log("custom event", struct {
+		Type   string                 `json:"type"`
+		Params map[string]interface{} `json:"params"`
+	}{eventType, params}, fmt.Sprintf("%s %v", eventType, params))
+}
+
+func (e *DebugExporter) RecordCustomMetric(name string, value float64) {
+	e.log("custom metric", struct {
+		Name  string  `json:"name"`
+		Value float64 `json:"value"`
+	}{name, value}, fmt.Sprintf("%s %v", name, value))
+}
+
+func (e *DebugExporter) RecordLog(logEvent newrelic.LogData) {
+	e.log("log", logEvent, fmt.Sprintf("%s %s", logEvent.Severity, logEvent.Message))
+}
+
+func (e *DebugExporter) logTransaction(txn *RecordedTransaction) {
+	recorded := e.Recorder.release(txn)
+	if recorded.Ignored {
+		return
+	}
+
+	t := debugTransaction{
+		Name:       recorded.Name,
+		TraceID:    recorded.TraceID,
+		StatusCode: recorded.StatusCode,
+		DurationMs: durationMs(recorded.Duration),
+		Attributes: recorded.Attributes,
+	}
+	for _, err := range recorded.Errors {
+		t.Errors = append(t.Errors, err.Error())
+	}
+	for _, s := range recorded.Segments {
+		t.Segments = append(
+			t.Segments, debugSegment{
+				Name:       s.Name,
+				URL:        s.URL,
+				Procedure:  s.Procedure,
+				StatusCode: s.StatusCode,
+				DurationMs: durationMs(s.Duration),
+				Attributes: s.Attributes,
+			},
+		)
+	}
+
+	e.log("transaction", t, t.String())
+}
+
+func (e *DebugExporter) log(kind string, v interface{}, text string) {
+	if e.format == DebugFormatJSON {
+		b, err := json.Marshal(v)
+		if err != nil {
+			e.logger.Error(debugLogPrefix, "unable to encode the", kind, err.Error())
+			return
+		}
+		text = string(b)
+	}
+	e.logger.Info(debugLogPrefix, kind, text)
+}
+
+func (t debugTransaction) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %.3fms", t.Name, t.DurationMs)
+	if t.StatusCode != 0 {
+		fmt.Fprintf(&b, " status=%d", t.StatusCode)
+	}
+	fmt.Fprintf(&b, " trace=%s", t.TraceID)
+	if len(t.Attributes) > 0 {
+		fmt.Fprintf(&b, " attributes=%v", t.Attributes)
+	}
+	for _, err := range t.Errors {
+		fmt.Fprintf(&b, "\n  error %s", err)
+	}
+	for _, s := range t.Segments {
+		fmt.Fprintf(&b, "\n  segment %s %.3fms", s.Name, s.DurationMs)
+		if s.StatusCode != 0 {
+			fmt.Fprintf(&b, " status=%d", s.StatusCode)
+		}
+		if s.URL != "" {
+			fmt.Fprintf(&b, " url=%s", s.URL)
+		}
+		if len(s.Attributes) > 0 {
+			fmt.Fprintf(&b, " attributes=%v", s.Attributes)
+		}
+	}
+	return b.String()
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugExporter(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		ignore   bool
+		want     []string
+		dontWant []string
+	}{
+		{
+			name:   "given the text format, it should log the transaction in a readable form",
+			format: DebugFormatText,
+			want: []string{
+				"transaction /users",
+				"status=502",
+				"attributes=map[",
+				"error 502 Bad Gateway",
+				"segment (proxy) /users",
+				"segment External/backend:8080/http/GET",
+				"url=http://backend:8080/users",
+				"custom metric Custom/Lookups 1",
+			},
+		},
+		{
+			name:   "given the json format, it should log the transaction as JSON",
+			format: DebugFormatJSON,
+			want: []string{
+				`{"name":"/users",`,
+				`"statusCode":502`,
+				`"errors":["502 Bad Gateway","502 Bad Gateway"]`,
+				`{"name":"External/backend:8080/http/GET","url":"http://backend:8080/users"`,
+				`{"name":"Custom/Lookups","value":1}`,
+			},
+		},
+		{
+			name:     "given an ignored transaction, it should not log it",
+			format:   DebugFormatText,
+			ignore:   true,
+			want:     []string{"custom metric Custom/Lookups 1"},
+			dontWant: []string{"transaction /users"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				buf := &bytes.Buffer{}
+				logger, err := logging.NewLogger("DEBUG", buf, "")
+				if !assert.NoError(t, err) {
+					return
+				}
+				exporter, err := NewDebugExporter(logger, tt.format)
+				if !assert.NoError(t, err) {
+					return
+				}
+				app = &Application{
+					TransactionManager: exporter,
+					NRApplication:      exporter,
+					Config: Config{
+						InstrumentationRate: 100,
+						StatusCodes:         &StatusCodeClassification{},
+					},
+				}
+				defer func() { app = nil }()
+
+				backendURL, _ := url.Parse("http://backend:8080/users")
+				backend := NewBackend(
+					"backend", func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+						return nil, responseError(http.StatusBadGateway)
+					},
+				)
+				handler := HandlerFactory(
+					func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+						return func(c *gin.Context) {
+							_, _ = p(c, &proxy.Request{Method: http.MethodGet, URL: backendURL, Headers: map[string][]string{}})
+							app.RecordCustomMetric("Custom/Lookups", 1)
+							if tt.ignore {
+								app.TransactionManager.TransactionFromContext(c).(TransactionIgnorer).Ignore()
+							}
+							c.Status(http.StatusBadGateway)
+						}
+					},
+				)(&config.EndpointConfig{Method: http.MethodGet, Endpoint: "/users"}, NewProxyMiddleware("(proxy) /users")(backend))
+
+				gin.SetMode(gin.TestMode)
+				e := gin.New()
+				e.Use(Middleware())
+				e.GET("/users", handler)
+				e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users", nil))
+
+				for _, want := range tt.want {
+					assert.Contains(t, buf.String(), want)
+				}
+				for _, dontWant := range tt.dontWant {
+					assert.NotContains(t, buf.String(), dontWant)
+				}
+				assert.Empty(t, exporter.Transactions())
+			},
+		)
+	}
+}
+
+func TestNewDebugExporter_unknownFormat(t *testing.T) {
+	_, err := NewDebugExporter(logging.NoOp, "yaml")
+	assert.Error(t, err)
+}
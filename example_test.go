@@ -2,7 +2,9 @@ package metrics_test
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 
 	"github.com/gin-gonic/gin"
 	metrics "github.com/jbactad/krakend-newrelic-v2"
@@ -52,3 +54,40 @@ func ExampleRegister() {
 	logger.Info("Starting the KrakenD instance")
 	routerFactory.NewWithContext(context.Background()).Run(cfg)
 }
+
+func ExampleNewRecorder() {
+	cfg := config.ExtraConfig{
+		"github_com/jbactad/krakend_newrelic_v2": map[string]interface{}{
+			"rate": 100,
+		},
+	}
+
+	recorder := metrics.NewRecorder()
+	app, err := metrics.NewApp(
+		cfg, func() (metrics.NRApplication, error) {
+			return recorder, nil
+		},
+		recorder,
+	)
+	if err != nil {
+		return
+	}
+	metrics.RegisterApp(app)
+
+	p := metrics.NewProxyMiddleware("(proxy) /users")(
+		func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{}, nil
+		},
+	)
+	handlerFactory := metrics.HandlerFactory(router.EndpointHandler)
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(metrics.Middleware())
+	engine.GET("/users", handlerFactory(&config.EndpointConfig{Method: http.MethodGet, Endpoint: "/users"}, p))
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users", nil))
+
+	txn, _ := recorder.Transaction("/users")
+	fmt.Println(txn.SegmentNames())
+	// Output: [(proxy) /users]
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ExclusionConfig defines the requests not instrumented. A request matching any of the rules is excluded.
+type ExclusionConfig struct {
+	Paths      []string `json:"paths"`
+	Prefixes   []string `json:"prefixes"`
+	Patterns   []string `json:"patterns"`
+	Methods    []string `json:"methods"`
+	UserAgents []string `json:"user_agents"`
+}
+
+type exclusionRules struct {
+	paths      map[string]struct{}
+	prefixes   []string
+	patterns   []*regexp.Regexp
+	methods    map[string]struct{}
+	userAgents []string
+}
+
+func newExclusionRules(conf ExclusionConfig) (exclusionRules, error) {
+	rules := exclusionRules{
+		prefixes: conf.Prefixes,
+	}
+	if len(conf.Paths) > 0 {
+		rules.paths = make(map[string]struct{}, len(conf.Paths))
+		for _, p := range conf.Paths {
+			rules.paths[p] = struct{}{}
+		}
+	}
+	for _, p := range conf.Patterns {
+		pattern, err := regexp.Compile(p)
+		if err != nil {
+			return exclusionRules{}, fmt.Errorf("invalid exclude pattern %s: %w", p, err)
+		}
+		rules.patterns = append(rules.patterns, pattern)
+	}
+	if len(conf.Methods) > 0 {
+		rules.methods = make(map[string]struct{}, len(conf.Methods))
+		for _, m := range conf.Methods {
+			rules.methods[strings.ToUpper(m)] = struct{}{}
+		}
+	}
+	for _, ua := range conf.UserAgents {
+		if ua == "" {
+			continue
+		}
+		rules.userAgents = append(rules.userAgents, strings.ToLower(ua))
+	}
+
+	return rules, nil
+}
+
+func (r exclusionRules) empty() bool {
+	return len(r.paths) == 0 && len(r.prefixes) == 0 && len(r.patterns) == 0 &&
+		len(r.methods) == 0 && len(r.userAgents) == 0
+}
+
+// excludes tells whether the request matches any of the rules.
+// The user agents match when the User-Agent header contains them, ignoring the case.
+func (r exclusionRules) excludes(req *http.Request) bool {
+	path := req.URL.Path
+	if _, ok := r.paths[path]; ok {
+		return true
+	}
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	for _, pattern := range r.patterns {
+		if pattern.MatchString(path) {
+			return true
+		}
+	}
+	if _, ok := r.methods[req.Method]; ok {
+		return true
+	}
+	if len(r.userAgents) > 0 {
+		userAgent := strings.ToLower(req.UserAgent())
+		for _, ua := range r.userAgents {
+			if strings.Contains(userAgent, ua) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware_exclusions(t *testing.T) {
+	conf := ExclusionConfig{
+		Paths:      []string{"/__health"},
+		Prefixes:   []string{"/__debug/"},
+		Patterns:   []string{`^/__stats(/.*)?$`},
+		Methods:    []string{"options"},
+		UserAgents: []string{"kube-probe"},
+	}
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		userAgent    string
+		wantSampled  bool
+		wantExcluded uint64
+	}{
+		{
+			name:        "given a request matching no rule, it should be instrumented",
+			method:      http.MethodGet,
+			path:        "/users",
+			wantSampled: true,
+		},
+		{
+			name:         "given an excluded path, it should not be instrumented",
+			method:       http.MethodGet,
+			path:         "/__health",
+			wantExcluded: 1,
+		},
+		{
+			name:        "given a path only starting like an excluded path, it should be instrumented",
+			method:      http.MethodGet,
+			path:        "/__health/details",
+			wantSampled: true,
+		},
+		{
+			name:         "given an excluded prefix, it should not be instrumented",
+			method:       http.MethodGet,
+			path:         "/__debug/pprof",
+			wantExcluded: 1,
+		},
+		{
+			name:         "given a path matching an excluded pattern, it should not be instrumented",
+			method:       http.MethodGet,
+			path:         "/__stats/backends",
+			wantExcluded: 1,
+		},
+		{
+			name:         "given an excluded method, it should not be instrumented",
+			method:       http.MethodOptions,
+			path:         "/users",
+			wantExcluded: 1,
+		},
+		{
+			name:         "given an excluded user agent, it should not be instrumented",
+			method:       http.MethodGet,
+			path:         "/users",
+			userAgent:    "Kube-Probe/1.25",
+			wantExcluded: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				sampled := false
+				defer func(provider func(NRApplication) gin.HandlerFunc) {
+					ginMiddlewareProvider = provider
+				}(ginMiddlewareProvider)
+				ginMiddlewareProvider = func(application NRApplication) gin.HandlerFunc {
+					return func(c *gin.Context) {
+						sampled = true
+					}
+				}
+				exclusions, err := newExclusionRules(conf)
+				if !assert.NoError(t, err) {
+					return
+				}
+				app = &Application{
+					Config:     Config{InstrumentationRate: 100, Exclude: conf},
+					exclusions: exclusions,
+				}
+				defer func() { app = nil }()
+
+				gin.SetMode(gin.TestMode)
+				e := gin.New()
+				e.Use(Middleware())
+				req := httptest.NewRequest(tt.method, tt.path, nil)
+				req.Header.Set("User-Agent", tt.userAgent)
+				e.ServeHTTP(httptest.NewRecorder(), req)
+
+				assert.Equal(t, tt.wantSampled, sampled)
+				assert.Equal(t, tt.wantExcluded, app.Status().Dropped.ExcludedRequests)
+			},
+		)
+	}
+}
+
+func Test_newExclusionRules(t *testing.T) {
+	tests := []struct {
+		name      string
+		conf      ExclusionConfig
+		wantEmpty bool
+		wantErr   assert.ErrorAssertionFunc
+	}{
+		{
+			name:      "given no rules, it should return empty rules",
+			conf:      ExclusionConfig{},
+			wantEmpty: true,
+			wantErr:   assert.NoError,
+		},
+		{
+			name:      "given only empty user agents, it should return empty rules",
+			conf:      ExclusionConfig{UserAgents: []string{""}},
+			wantEmpty: true,
+			wantErr:   assert.NoError,
+		},
+		{
+			name:    "given rules, it should return them",
+			conf:    ExclusionConfig{Methods: []string{"HEAD"}},
+			wantErr: assert.NoError,
+		},
+		{
+			name:    "given an invalid pattern, it should return an error",
+			conf:    ExclusionConfig{Patterns: []string{"("}},
+			wantErr: assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				rules, err := newExclusionRules(tt.conf)
+				if !tt.wantErr(t, err) || err != nil {
+					return
+				}
+				assert.Equal(t, tt.wantEmpty, rules.empty())
+			},
+		)
+	}
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// GinMiddleware wraps a gin middleware registered on the engine, e.g. CORS or rate limiting, with a segment
+// named segmentName in the transaction started by Middleware, so it must be registered after it.
+// As gin middlewares run the rest of the chain when they call c.Next, the segment then includes it.
+// When the middleware aborts the request, the segment gets the aborted and http.statusCode attributes.
+func GinMiddleware(segmentName string, handler gin.HandlerFunc) gin.HandlerFunc {
+	if app == nil {
+		return handler
+	}
+	return func(c *gin.Context) {
+		txn := app.TransactionManager.TransactionFromContext(c)
+		if txn == nil {
+			handler(c)
+			return
+		}
+
+		segment := startSegment(txn, segmentName)
+		defer segment.End()
+		handler(c)
+
+		if !c.IsAborted() {
+			return
+		}
+		if s, ok := segment.(AttributeAdder); ok {
+			s.AddAttribute("aborted", true)
+			s.AddAttribute("http.statusCode", c.Writer.Status())
+		}
+	}
+}
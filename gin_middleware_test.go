@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGinMiddleware(t *testing.T) {
+	tests := []struct {
+		name           string
+		middleware     gin.HandlerFunc
+		wantStatus     int
+		wantAttributes map[string]interface{}
+	}{
+		{
+			name: "given a middleware running the chain, it should record its segment",
+			middleware: func(c *gin.Context) {
+				c.Header("Access-Control-Allow-Origin", "*")
+				c.Next()
+			},
+			wantStatus:     http.StatusOK,
+			wantAttributes: map[string]interface{}{},
+		},
+		{
+			name: "given a middleware aborting the request, it should flag its segment",
+			middleware: func(c *gin.Context) {
+				c.AbortWithStatus(http.StatusTooManyRequests)
+			},
+			wantStatus: http.StatusTooManyRequests,
+			wantAttributes: map[string]interface{}{
+				"aborted":         true,
+				"http.statusCode": http.StatusTooManyRequests,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				recorder := NewRecorder()
+				app = &Application{
+					TransactionManager: recorder,
+					NRApplication:      recorder,
+					Config:             Config{InstrumentationRate: 100},
+				}
+				defer func() { app = nil }()
+
+				gin.SetMode(gin.TestMode)
+				e := gin.New()
+				e.Use(Middleware(), GinMiddleware("ratelimit", tt.middleware))
+				e.GET(
+					"/users", func(c *gin.Context) {
+						c.Status(http.StatusOK)
+					},
+				)
+				w := httptest.NewRecorder()
+				e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users", nil))
+				assert.Equal(t, tt.wantStatus, w.Code)
+
+				txns := recorder.Transactions()
+				if !assert.Len(t, txns, 1) {
+					return
+				}
+				segment, ok := txns[0].Segment("ratelimit")
+				if assert.True(t, ok) {
+					assert.True(t, segment.Ended)
+					assert.Equal(t, tt.wantAttributes, segment.Attributes)
+				}
+			},
+		)
+	}
+}
+
+func TestGinMiddleware_noApp(t *testing.T) {
+	called := false
+	handler := GinMiddleware(
+		"ratelimit", func(c *gin.Context) {
+			called = true
+		},
+	)
+	handler(&gin.Context{})
+	assert.True(t, called)
+}
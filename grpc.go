@@ -0,0 +1,235 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCNamespace is the extra_config namespace used by gRPC backends
+const GRPCNamespace = "backend/grpc"
+
+const grpcLibrary = "gRPC"
+
+// GRPCBackendFactory creates an instrumented backend factory for gRPC backends
+func GRPCBackendFactory(segmentName string, next proxy.BackendFactory) proxy.BackendFactory {
+	if app == nil {
+		return next
+	}
+
+	return func(cfg *config.Backend) proxy.Proxy {
+		return NewGRPCBackend(segmentName, cfg, next(cfg))
+	}
+}
+
+// NewGRPCBackend includes NewRelic segmentation for gRPC backends.
+// The service and method are taken from the backend url_pattern (/package.Service/Method)
+// and the trace headers are passed to the next proxy so they can be sent as gRPC metadata.
+func NewGRPCBackend(segmentName string, cfg *config.Backend, next proxy.Proxy) proxy.Proxy {
+	if app == nil {
+		return next
+	}
+
+	classification, err := statusCodeClassificationFor(cfg.ExtraConfig)
+	if err != nil {
+		app.log().Error("invalid status_codes for the backend", cfg.URLPattern, err.Error())
+	}
+	return newGRPCBackend(classification, cfg, next)
+}
+
+func newGRPCBackend(classification *StatusCodeClassification, cfg *config.Backend, next proxy.Proxy) proxy.Proxy {
+	host := ""
+	if len(cfg.Host) > 0 {
+		host = cfg.Host[0]
+	}
+	procedure := strings.TrimPrefix(cfg.URLPattern, "/")
+	backendURL := &url.URL{Scheme: "grpc", Host: host, Path: "/" + procedure}
+
+	return func(ctx context.Context, proxyReq *proxy.Request) (*proxy.Response, error) {
+		ctx, tx := transactionFor(ctx, proxyReq)
+		if tx == nil {
+			ctx, tx = startStandaloneTransaction(ctx, backendTransactionName(proxyReq, cfg.URLPattern))
+			if tx == nil {
+				return next(ctx, proxyReq)
+			}
+			defer tx.End()
+		}
+
+		segment := startRPCSegment(tx, grpcLibrary, host, procedure)
+		defer segment.End()
+		deadline := deadlineAttributes(ctx, segment, cfg.Timeout)
+
+		hdrs := http.Header(proxy.CloneRequestHeaders(proxyReq.Headers))
+		if !provisionalTransaction(ctx) {
+			tx.InsertDistributedTraceHeaders(hdrs)
+		}
+
+		req := proxyReq.Clone()
+		req.Headers = hdrs
+
+		start := time.Now()
+		resp, err := next(ctx, &req)
+		code := grpcStatusCode(err)
+		addGRPCAttributes(segment, procedure, err)
+		if details := requestDetailsFromContext(ctx); details != nil {
+			details.addBackend(backendURL, time.Since(start), int(code))
+		}
+		if source := grpcTimeoutSource(ctx, err); source != "" {
+			if s, ok := segment.(AttributeAdder); ok {
+				s.AddAttribute("timeout.source", source)
+			}
+			deadline["backend.url"] = backendURL.String()
+			noticeTimeout(tx, source, err, deadline)
+		} else {
+			noticeStatusCode(
+				tx, classification, grpcHTTPStatusCode(code),
+				map[string]interface{}{"backend.url": backendURL.String(), "grpc.statusCode": int(code)},
+			)
+		}
+
+		return resp, err
+	}
+}
+
+// UnaryClientInterceptor instruments unary calls made through a grpc.ClientConn.
+// It records the call as an external segment and propagates the trace headers as outgoing metadata.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	if app == nil {
+		return func(
+			ctx context.Context,
+			method string,
+			req, reply interface{},
+			cc *grpc.ClientConn,
+			invoker grpc.UnaryInvoker,
+			opts ...grpc.CallOption,
+		) error {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+	}
+
+	return func(
+		ctx context.Context,
+		method string,
+		req, reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		tx := app.TransactionManager.TransactionFromContext(ctx)
+		if tx == nil {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		procedure := strings.TrimPrefix(method, "/")
+		segment := startRPCSegment(tx, grpcLibrary, cc.Target(), procedure)
+		defer segment.End()
+
+		hdrs := http.Header{}
+		if !provisionalTransaction(ctx) {
+			tx.InsertDistributedTraceHeaders(hdrs)
+		}
+		for k, vs := range hdrs {
+			for _, v := range vs {
+				ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(k), v)
+			}
+		}
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		addGRPCAttributes(segment, procedure, err)
+
+		return err
+	}
+}
+
+func isGRPCBackend(cfg *config.Backend) bool {
+	_, ok := cfg.ExtraConfig[GRPCNamespace]
+	return ok
+}
+
+func addGRPCAttributes(segment AttributeAdder, procedure string, err error) {
+	service, method := splitProcedure(procedure)
+	code := grpcStatusCode(err)
+
+	segment.AddAttribute("grpc.service", service)
+	segment.AddAttribute("grpc.method", method)
+	segment.AddAttribute("grpc.statusCode", int(code))
+	segment.AddAttribute("grpc.status", code.String())
+}
+
+func splitProcedure(procedure string) (string, string) {
+	i := strings.LastIndex(procedure, "/")
+	if i < 0 {
+		return procedure, ""
+	}
+	return procedure[:i], procedure[i+1:]
+}
+
+// grpcTimeoutSource is the timeoutSource of the gRPC calls, which also time out with the DeadlineExceeded status
+func grpcTimeoutSource(ctx context.Context, err error) string {
+	if source := timeoutSource(ctx, err); source != "" {
+		return source
+	}
+	if grpcStatusCode(err) == codes.DeadlineExceeded {
+		return timeoutSourceBackend
+	}
+	return ""
+}
+
+// grpcHTTPStatusCode maps the gRPC status code to the HTTP one, as the gRPC gateways do, so it can be classified
+func grpcHTTPStatusCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func grpcStatusCode(err error) codes.Code {
+	if err == nil {
+		return codes.OK
+	}
+
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		return grpcErr.GRPCStatus().Code()
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	}
+
+	return codes.Unknown
+}
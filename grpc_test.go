@@ -0,0 +1,455 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/newrelic/go-agent/v3/newrelic"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestNewGRPCBackend(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	type args struct {
+		cfg     *config.Backend
+		request *proxy.Request
+		next    proxy.Proxy
+	}
+	tests := []struct {
+		name        string
+		args        args
+		app         *Application
+		wantHeaders map[string][]string
+		wantErr     assert.ErrorAssertionFunc
+	}{
+		{
+			name: "given app is registered, it should record the gRPC call and propagate trace headers",
+			args: args{
+				cfg: &config.Backend{
+					Host:       []string{"grpc-backend:50051"},
+					URLPattern: "/grpc.health.v1.Health/Check",
+					ExtraConfig: config.ExtraConfig{
+						GRPCNamespace: map[string]interface{}{},
+					},
+				},
+				request: &proxy.Request{
+					Headers: map[string][]string{"X-Original": {"value"}},
+				},
+				next: func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+					return &proxy.Response{Metadata: proxy.Metadata{Headers: request.Headers}}, nil
+				},
+			},
+			app: func() *Application {
+				tm := newMockRPCTransactionManager(ctrl)
+				tx := NewMockTransaction(ctrl)
+				seg := NewMockSegment(ctrl)
+
+				tm.EXPECT().TransactionFromContext(gomock.Any()).Return(tx)
+				tm.rpc.EXPECT().StartRPCSegment(tx, "gRPC", "grpc-backend:50051", "grpc.health.v1.Health/Check").
+					Return(seg)
+				tx.EXPECT().InsertDistributedTraceHeaders(gomock.Any()).Do(
+					func(hdrs http.Header) {
+						hdrs.Set("Newrelic", "payload")
+					},
+				)
+				seg.EXPECT().AddAttribute("grpc.service", "grpc.health.v1.Health")
+				seg.EXPECT().AddAttribute("grpc.method", "Check")
+				seg.EXPECT().AddAttribute("grpc.statusCode", 0)
+				seg.EXPECT().AddAttribute("grpc.status", "OK")
+				seg.EXPECT().End()
+
+				return &Application{TransactionManager: tm, NRApplication: NewMockNRApplication(ctrl)}
+			}(),
+			wantHeaders: map[string][]string{
+				"X-Original": {"value"},
+				"Newrelic":   {"payload"},
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			name: "given the backend fails with a gRPC status, it should record the status code",
+			args: args{
+				cfg: &config.Backend{
+					URLPattern: "/grpc.health.v1.Health/Check",
+				},
+				request: &proxy.Request{},
+				next: func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+					return nil, status.Error(codes.Unavailable, "backend is down")
+				},
+			},
+			app: func() *Application {
+				tm := newMockRPCTransactionManager(ctrl)
+				tx := NewMockTransaction(ctrl)
+				seg := NewMockSegment(ctrl)
+
+				tm.EXPECT().TransactionFromContext(gomock.Any()).Return(tx)
+				tm.rpc.EXPECT().StartRPCSegment(tx, "gRPC", "", "grpc.health.v1.Health/Check").Return(seg)
+				tx.EXPECT().InsertDistributedTraceHeaders(gomock.Any())
+				seg.EXPECT().AddAttribute("grpc.service", "grpc.health.v1.Health")
+				seg.EXPECT().AddAttribute("grpc.method", "Check")
+				seg.EXPECT().AddAttribute("grpc.statusCode", int(codes.Unavailable))
+				seg.EXPECT().AddAttribute("grpc.status", "Unavailable")
+				seg.EXPECT().End()
+
+				return &Application{TransactionManager: tm, NRApplication: NewMockNRApplication(ctrl)}
+			}(),
+			wantErr: assert.Error,
+		},
+		{
+			name: "given transaction is nil, it should not start a segment",
+			args: args{
+				cfg:     &config.Backend{},
+				request: &proxy.Request{},
+				next: func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+					return &proxy.Response{}, nil
+				},
+			},
+			app: func() *Application {
+				tm := NewMockTransactionManager(ctrl)
+				tm.EXPECT().TransactionFromContext(gomock.Any()).Return(nil)
+
+				return &Application{TransactionManager: tm, NRApplication: NewMockNRApplication(ctrl)}
+			}(),
+			wantErr: assert.NoError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				app = tt.app
+				backendProxy := BackendFactory(
+					"backend", func(*config.Backend) proxy.Proxy {
+						return tt.args.next
+					},
+				)(tt.args.cfg)
+				if !isGRPCBackend(tt.args.cfg) {
+					backendProxy = NewGRPCBackend("backend", tt.args.cfg, tt.args.next)
+				}
+
+				resp, err := backendProxy(context.Background(), tt.args.request)
+				if !tt.wantErr(t, err, "NewGRPCBackend()") {
+					return
+				}
+				if tt.wantHeaders != nil {
+					assert.Equal(t, tt.wantHeaders, resp.Metadata.Headers)
+					assert.NotContains(t, tt.args.request.Headers, "Newrelic")
+				}
+			},
+		)
+	}
+}
+
+func TestBackendFactory_grpcErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		statusCodes    *StatusCodeClassification
+		backend        proxy.Proxy
+		wantErrorClass string
+		wantSource     string
+		wantExpected   bool
+	}{
+		{
+			name: "given the endpoint timeout cancels the call, it should notice a gateway timeout",
+			backend: func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+				<-ctx.Done()
+				return nil, status.FromContextError(ctx.Err()).Err()
+			},
+			wantErrorClass: GatewayTimeoutErrorClass,
+			wantSource:     timeoutSourceGateway,
+		},
+		{
+			name: "given the backend times out on its own, it should notice a backend timeout",
+			backend: func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+				return nil, status.Error(codes.DeadlineExceeded, "deadline exceeded")
+			},
+			wantErrorClass: BackendTimeoutErrorClass,
+			wantSource:     timeoutSourceBackend,
+		},
+		{
+			name:        "given an error status classified as an error, it should notice its http status code",
+			statusCodes: &StatusCodeClassification{},
+			backend: func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+				return nil, status.Error(codes.Unavailable, "backend is down")
+			},
+			wantErrorClass: "503",
+		},
+		{
+			name:        "given an error status classified as expected, it should only mark the transaction",
+			statusCodes: &StatusCodeClassification{ExpectedStatusCodes: []int{http.StatusNotFound}},
+			backend: func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+				return nil, status.Error(codes.NotFound, "unknown user")
+			},
+			wantExpected: true,
+		},
+		{
+			name: "given an error status without classification, it should not notice it",
+			backend: func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+				return nil, status.Error(codes.Unavailable, "backend is down")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				recorder := NewRecorder()
+				app = &Application{
+					TransactionManager: recorder,
+					NRApplication:      recorder,
+					Config:             Config{InstrumentationRate: 100, StatusCodes: tt.statusCodes},
+				}
+				defer func() { app = nil }()
+
+				p := BackendFactory(
+					"backend", func(*config.Backend) proxy.Proxy {
+						return tt.backend
+					},
+				)(
+					&config.Backend{
+						Host:        []string{"grpc-backend:50051"},
+						URLPattern:  "/users.Users/Get",
+						Timeout:     50 * time.Millisecond,
+						ExtraConfig: config.ExtraConfig{GRPCNamespace: map[string]interface{}{}},
+					},
+				)
+
+				ctx, txn := recorder.StartTransactionContext(context.Background(), "/users")
+				ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+				defer cancel()
+				_, err := p(ctx, &proxy.Request{Headers: map[string][]string{}})
+				txn.End()
+				assert.Error(t, err)
+
+				recorded, _ := recorder.Transaction("/users")
+				segment, ok := recorded.Segment("users.Users/Get")
+				if !assert.True(t, ok) {
+					return
+				}
+				assert.Equal(t, int64(50), segment.Attributes["endpoint.timeoutMs"])
+				assert.Contains(t, segment.Attributes, "deadline.remainingMs")
+				assert.Equal(t, tt.wantExpected, recorded.Attributes["error.expected"] == true)
+
+				if tt.wantErrorClass == "" {
+					assert.Empty(t, recorded.Errors)
+					return
+				}
+				if !assert.Len(t, recorded.Errors, 1) {
+					return
+				}
+				noticed, ok := recorded.Errors[0].(newrelic.Error)
+				if !assert.True(t, ok) {
+					return
+				}
+				assert.Equal(t, tt.wantErrorClass, noticed.Class)
+				assert.Equal(t, "grpc://grpc-backend:50051/users.Users/Get", noticed.Attributes["backend.url"])
+				if tt.wantSource != "" {
+					assert.Equal(t, tt.wantSource, segment.Attributes["timeout.source"])
+					assert.Equal(t, tt.wantSource, noticed.Attributes["timeout.source"])
+					assert.Equal(t, int64(50), noticed.Attributes["endpoint.timeoutMs"])
+				}
+			},
+		)
+	}
+}
+
+func TestBackendFactory_grpcStandaloneTransaction(t *testing.T) {
+	recorder := NewRecorder()
+	app = &Application{
+		TransactionManager: recorder,
+		NRApplication:      recorder,
+		Config: Config{
+			InstrumentationRate:    100,
+			StandaloneTransactions: StandaloneTransactionConfig{Enabled: true},
+		},
+	}
+	defer func() { app = nil }()
+
+	p := BackendFactory(
+		"backend", func(*config.Backend) proxy.Proxy {
+			return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+				return &proxy.Response{IsComplete: true}, nil
+			}
+		},
+	)(
+		&config.Backend{
+			Host:        []string{"grpc-backend:50051"},
+			URLPattern:  "/users.Users/Get",
+			ExtraConfig: config.ExtraConfig{GRPCNamespace: map[string]interface{}{}},
+		},
+	)
+
+	backendURL, _ := url.Parse("http://grpc-backend:50051/users.Users/Get")
+	_, err := p(context.Background(), &proxy.Request{URL: backendURL, Headers: map[string][]string{}})
+	assert.NoError(t, err)
+
+	transactions := recorder.Transactions()
+	if assert.Len(t, transactions, 1) {
+		assert.Equal(t, "Backend/grpc-backend:50051/users.Users/Get", transactions[0].Name)
+		assert.True(t, transactions[0].Ended)
+		assert.Equal(t, true, transactions[0].Attributes["standalone"])
+		assert.Equal(t, []string{"users.Users/Get"}, transactions[0].SegmentNames())
+	}
+}
+
+func TestUnaryClientInterceptor(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	listener := bufconn.Listen(1024 * 1024)
+	incoming := make(chan metadata.MD, 1)
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(
+			func(
+				ctx context.Context,
+				req interface{},
+				info *grpc.UnaryServerInfo,
+				handler grpc.UnaryHandler,
+			) (interface{}, error) {
+				md, _ := metadata.FromIncomingContext(ctx)
+				incoming <- md
+				return handler(ctx, req)
+			},
+		),
+	)
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("down", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	grpc_health_v1.RegisterHealthServer(srv, healthServer)
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	defer srv.Stop()
+
+	tests := []struct {
+		name       string
+		service    string
+		app        *Application
+		wantCode   codes.Code
+		wantHeader string
+	}{
+		{
+			name:    "given a transaction, it should record the call and send trace metadata",
+			service: "",
+			app: func() *Application {
+				tm := newMockRPCTransactionManager(ctrl)
+				tx := NewMockTransaction(ctrl)
+				seg := NewMockSegment(ctrl)
+
+				tm.EXPECT().TransactionFromContext(gomock.Any()).Return(tx)
+				tm.rpc.EXPECT().StartRPCSegment(tx, "gRPC", "bufnet", "grpc.health.v1.Health/Check").Return(seg)
+				tx.EXPECT().InsertDistributedTraceHeaders(gomock.Any()).Do(
+					func(hdrs http.Header) {
+						hdrs.Set("Traceparent", "00-trace-span-01")
+					},
+				)
+				seg.EXPECT().AddAttribute("grpc.service", "grpc.health.v1.Health")
+				seg.EXPECT().AddAttribute("grpc.method", "Check")
+				seg.EXPECT().AddAttribute("grpc.statusCode", int(codes.OK))
+				seg.EXPECT().AddAttribute("grpc.status", "OK")
+				seg.EXPECT().End()
+
+				return &Application{TransactionManager: tm, NRApplication: NewMockNRApplication(ctrl)}
+			}(),
+			wantCode:   codes.OK,
+			wantHeader: "00-trace-span-01",
+		},
+		{
+			name:    "given the server returns an error, it should record the gRPC status code",
+			service: "unknown",
+			app: func() *Application {
+				tm := newMockRPCTransactionManager(ctrl)
+				tx := NewMockTransaction(ctrl)
+				seg := NewMockSegment(ctrl)
+
+				tm.EXPECT().TransactionFromContext(gomock.Any()).Return(tx)
+				tm.rpc.EXPECT().StartRPCSegment(tx, "gRPC", "bufnet", "grpc.health.v1.Health/Check").Return(seg)
+				tx.EXPECT().InsertDistributedTraceHeaders(gomock.Any())
+				seg.EXPECT().AddAttribute("grpc.service", "grpc.health.v1.Health")
+				seg.EXPECT().AddAttribute("grpc.method", "Check")
+				seg.EXPECT().AddAttribute("grpc.statusCode", int(codes.NotFound))
+				seg.EXPECT().AddAttribute("grpc.status", "NotFound")
+				seg.EXPECT().End()
+
+				return &Application{TransactionManager: tm, NRApplication: NewMockNRApplication(ctrl)}
+			}(),
+			wantCode: codes.NotFound,
+		},
+		{
+			name:    "given app is nil, it should only invoke the call",
+			service: "",
+			app:     nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				app = tt.app
+
+				conn, err := grpc.DialContext(
+					context.Background(),
+					"bufnet",
+					grpc.WithContextDialer(
+						func(ctx context.Context, s string) (net.Conn, error) {
+							return listener.DialContext(ctx)
+						},
+					),
+					grpc.WithTransportCredentials(insecure.NewCredentials()),
+					grpc.WithUnaryInterceptor(UnaryClientInterceptor()),
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+
+				_, err = grpc_health_v1.NewHealthClient(conn).Check(
+					context.Background(),
+					&grpc_health_v1.HealthCheckRequest{Service: tt.service},
+				)
+				assert.Equal(t, tt.wantCode, status.Code(err))
+
+				md := <-incoming
+				if tt.wantHeader != "" {
+					assert.Equal(t, []string{tt.wantHeader}, md.Get("traceparent"))
+				}
+			},
+		)
+	}
+}
+
+func Test_grpcStatusCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{name: "given no error, it should return OK", err: nil, want: codes.OK},
+		{
+			name: "given a wrapped status error, it should return its code",
+			err:  fmt.Errorf("call failed: %w", status.Error(codes.PermissionDenied, "denied")),
+			want: codes.PermissionDenied,
+		},
+		{name: "given a deadline, it should return DeadlineExceeded", err: context.DeadlineExceeded, want: codes.DeadlineExceeded},
+		{name: "given an unknown error, it should return Unknown", err: errors.New("boom"), want: codes.Unknown},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				assert.Equal(t, tt.want, grpcStatusCode(tt.err))
+			},
+		)
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/luraproject/lura/v2/config"
@@ -21,7 +24,25 @@ var (
 
 // Config struct for NewRelic Krakend
 type Config struct {
-	InstrumentationRate int `json:"rate"`
+	InstrumentationRate    int                         `json:"rate"`
+	StatusCodes            *StatusCodeClassification   `json:"status_codes"`
+	SlowRequestThreshold   string                      `json:"slow_request_threshold"`
+	Exporter               string                      `json:"exporter"`
+	OTLP                   OTLPConfig                  `json:"otlp"`
+	Debug                  DebugConfig                 `json:"debug"`
+	Connection             ConnectionConfig            `json:"connection"`
+	StatusEndpoint         string                      `json:"status_endpoint"`
+	AdminToken             string                      `json:"admin_token"`
+	HashKey                string                      `json:"hash_key"`
+	Sampling               SamplingConfig              `json:"sampling"`
+	Exclude                ExclusionConfig             `json:"exclude"`
+	PayloadSizes           PayloadSizeConfig           `json:"payload_sizes"`
+	Cache                  CacheConfig                 `json:"cache"`
+	Auth                   AuthConfig                  `json:"auth"`
+	Client                 ClientConfig                `json:"client"`
+	StandaloneTransactions StandaloneTransactionConfig `json:"standalone_transactions"`
+	Streaming              StreamingConfig             `json:"streaming"`
+	Retries                RetryConfig                 `json:"retries"`
 }
 
 type NRApplication interface {
@@ -60,15 +81,56 @@ type StatusCodeSetter interface {
 	SetStatusCode(code int)
 }
 
+type AttributeAdder interface {
+	AddAttribute(key string, val interface{})
+}
+
+// ErrorNoticer is implemented by the transactions noticing errors
+type ErrorNoticer interface {
+	NoticeError(err error)
+}
+
+// TransactionIgnorer is implemented by the transactions that can be ignored
+type TransactionIgnorer interface {
+	Ignore()
+}
+
+type Segment interface {
+	TransactionEnder
+	AttributeAdder
+}
+
 type TransactionManager interface {
 	TransactionFromContext(ctx context.Context) Transaction
 	StartExternalSegment(txn Transaction, request *http.Request) TransactionEndStatusCodeSetter
 }
 
+// RPCSegmentStarter is implemented by the transaction managers starting their own segments for the RPC calls
+type RPCSegmentStarter interface {
+	StartRPCSegment(txn Transaction, library, host, procedure string) Segment
+}
+
+// segmentStarter is implemented by the transactions whose segments are not newrelic segments
+type segmentStarter interface {
+	startSegment(name string) Segment
+}
+
 type Application struct {
 	TransactionManager TransactionManager
 	NRApplication
 	Config Config
+
+	slowRequestThreshold    time.Duration
+	slowRequestThresholds   sync.Map
+	connectionTimeout       time.Duration
+	connectionRetryInterval time.Duration
+	connection              connectionState
+	instrumentation         instrumentationState
+	samplingRate            atomic.Value
+	samplingWatchInterval   time.Duration
+	exclusions              exclusionRules
+	hashKey                 []byte
+	logger                  logging.Logger
 }
 
 type NewRelicAppFactoryFunc func() (NRApplication, error)
@@ -76,52 +138,154 @@ type NewRelicAppFactoryFunc func() (NRApplication, error)
 // ConfigGetter gets config for NewRelic
 func ConfigGetter(cfg config.ExtraConfig) (Config, error) {
 	result := Config{}
+	err := decodeExtraConfig(cfg, &result)
+
+	return result, err
+}
+
+func decodeExtraConfig(cfg config.ExtraConfig, result interface{}) error {
 	v, ok := cfg[Namespace]
 	if !ok {
-		return result, fmt.Errorf("namespace %s is not defined in extra_config", Namespace)
+		return fmt.Errorf("namespace %s is not defined in extra_config", Namespace)
 	}
 	tmp, ok := v.(map[string]interface{})
 	if !ok {
-		return result, fmt.Errorf("cannot map config to map string interface")
+		return fmt.Errorf("cannot map config to map string interface")
 	}
 
 	marshaledConf, err := json.Marshal(tmp)
 	if err != nil {
-		return result, err
+		return err
 	}
 
-	err = json.Unmarshal(marshaledConf, &result)
-
-	return result, err
+	return json.Unmarshal(marshaledConf, result)
 }
 
 // Register initializes the metrics collector.
-// Returns a newrelic.Application instance.
+// The options are applied to the newrelic agent config after the environment variables.
+// Returns a newrelic.Application instance, or nil when the exporter is not newrelic.
 func Register(
 	ctx context.Context,
 	cfg config.ExtraConfig,
 	logger logging.Logger,
+	opts ...newrelic.ConfigOption,
 ) *newrelic.Application {
-	var err error
-	app, err = NewApp(
-		cfg, func() (NRApplication, error) {
-			return newrelic.NewApplication(
-				newrelic.ConfigFromEnvironment(),
-			)
-		},
-		newrelicWrapper{},
-	)
+	nrApp, err := RegisterWithError(ctx, cfg, logger, opts...)
 	if err != nil {
 		logger.Error("error initializing metrics collector", err.Error())
-		return nil
 	}
 
-	err = app.WaitForConnection(time.Second * 5)
+	return nrApp
+}
+
+// RegisterWithError initializes the metrics collector like Register, but returns the error instead of logging it.
+// With the fail connection wait, an error is returned and the middlewares are disabled when the agent does not
+// connect in time.
+func RegisterWithError(
+	ctx context.Context,
+	cfg config.ExtraConfig,
+	logger logging.Logger,
+	opts ...newrelic.ConfigOption,
+) (*newrelic.Application, error) {
+	var err error
+	conf, _ := ConfigGetter(cfg)
+	nrAppFactory, manager := exporterFactory(ctx, conf, logger, opts...)
+	app, err = NewApp(cfg, nrAppFactory, manager)
 	if err != nil {
-		logger.Error("error initializing metrics collector", err.Error())
+		return nil, err
+	}
+	app.logger = logger
+
+	if err = app.Connect(ctx, logger); err != nil {
+		app.Shutdown(0)
+		app = nil
+		return nil, err
+	}
+	app.WatchSamplingRate(ctx, logger)
+
+	nrApp, _ := app.NRApplication.(*newrelic.Application)
+	return nrApp, nil
+}
+
+// RegisterApp sets the Application used by the middlewares.
+// It allows using an Application created by NewApp, e.g. with a Recorder in tests.
+func RegisterApp(application *Application) {
+	app = application
+}
+
+// exporterFactory returns the application factory and the transaction manager of the configured exporter
+// customDataFeatures returns the features enabled in the service recording custom events or metrics
+func customDataFeatures(conf Config) []string {
+	var features []string
+	if conf.SlowRequestThreshold != "" {
+		features = append(features, "slow_request_threshold")
+	}
+	if conf.Streaming.Enabled {
+		features = append(features, "streaming")
+	}
+	if conf.Client.Metrics {
+		features = append(features, "client.metrics")
+	}
+	if conf.Cache.Metrics {
+		features = append(features, "cache.metrics")
+	}
+	if conf.PayloadSizes.Metrics {
+		features = append(features, "payload_sizes.metrics")
+	}
+	return features
+}
+
+func exporterFactory(
+	ctx context.Context,
+	conf Config,
+	logger logging.Logger,
+	opts ...newrelic.ConfigOption,
+) (NewRelicAppFactoryFunc, TransactionManager) {
+	switch conf.Exporter {
+	case "", ExporterNewRelic:
+		return func() (NRApplication, error) {
+			return newrelic.NewApplication(
+				append(
+					[]newrelic.ConfigOption{
+						newrelic.ConfigFromEnvironment(),
+						statusCodeClassificationOption(conf.StatusCodes),
+					},
+					opts...,
+				)...,
+			)
+		}, newrelicWrapper{}
+	case ExporterOTLP:
+		exporter, err := NewOTLPExporter(ctx, conf.OTLP)
+		if err != nil {
+			return func() (NRApplication, error) {
+				return nil, err
+			}, nil
+		}
+		if features := customDataFeatures(conf); len(features) > 0 {
+			logger.Warning(
+				"the otlp exporter does not send the custom events and metrics, the data of",
+				strings.Join(features, ", "), "is dropped",
+			)
+		}
+		otelApp := NewOTelApplication(otlpServiceName(conf.OTLP), exporter)
+		return func() (NRApplication, error) {
+			return otelApp, nil
+		}, otelApp
+	case ExporterDebug:
+		debugExporter, err := NewDebugExporter(logger, conf.Debug.Format)
+		if err != nil {
+			return func() (NRApplication, error) {
+				return nil, err
+			}, nil
+		}
+		return func() (NRApplication, error) {
+			return debugExporter, nil
+		}, debugExporter
 	}
 
-	return app.NRApplication.(*newrelic.Application)
+	return func() (NRApplication, error) {
+		return nil, fmt.Errorf("unknown exporter %s", conf.Exporter)
+	}, nil
 }
 
 // NewApp creates a new Application that wraps the newrelic application
@@ -135,21 +299,146 @@ func NewApp(
 		return nil, fmt.Errorf("no config for the NR module: %w", err)
 	}
 
+	var slowRequestThreshold time.Duration
+	if conf.SlowRequestThreshold != "" {
+		slowRequestThreshold, err = time.ParseDuration(conf.SlowRequestThreshold)
+		if err != nil {
+			return nil, fmt.Errorf("invalid slow_request_threshold for the NR module: %w", err)
+		}
+	}
+
+	connectionTimeout, connectionRetryInterval, err := parseConnectionConfig(conf.Connection)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection for the NR module: %w", err)
+	}
+
+	var samplingWatchInterval time.Duration
+	if conf.Sampling.WatchInterval != "" {
+		samplingWatchInterval, err = time.ParseDuration(conf.Sampling.WatchInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sampling watch_interval for the NR module: %w", err)
+		}
+	}
+
+	exclusions, err := newExclusionRules(conf.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude for the NR module: %w", err)
+	}
+
+	if err := validateAuthConfig(conf.Auth); err != nil {
+		return nil, fmt.Errorf("invalid auth for the NR module: %w", err)
+	}
+
+	if err := validateHashKey(conf); err != nil {
+		return nil, fmt.Errorf("invalid hash_key for the NR module: %w", err)
+	}
+	var hashKey []byte
+	if conf.HashKey != "" {
+		hashKey = []byte(conf.HashKey)
+	}
+
 	nrApp, err := nrAppFactory()
 	if err != nil {
 		return nil, fmt.Errorf("unable to start the NR module: %w", err)
 	}
 
-	return &Application{manager, nrApp, conf}, nil
+	return &Application{
+		TransactionManager:      manager,
+		NRApplication:           nrApp,
+		Config:                  conf,
+		slowRequestThreshold:    slowRequestThreshold,
+		connectionTimeout:       connectionTimeout,
+		connectionRetryInterval: connectionRetryInterval,
+		samplingWatchInterval:   samplingWatchInterval,
+		exclusions:              exclusions,
+		hashKey:                 hashKey,
+	}, nil
+}
+
+// log returns the logger of the application, discarding the logs when there is none
+func (a *Application) log() logging.Logger {
+	if a.logger == nil {
+		return logging.NoOp
+	}
+	return a.logger
 }
 
 type newrelicWrapper struct {
 }
 
 func (t newrelicWrapper) StartExternalSegment(txn Transaction, request *http.Request) TransactionEndStatusCodeSetter {
-	return newrelic.StartExternalSegment(txn.(*newrelic.Transaction), request)
+	return newrelicExternalSegment{newrelic.StartExternalSegment(toNewRelicTransaction(txn), request)}
 }
 
 func (t newrelicWrapper) TransactionFromContext(ctx context.Context) Transaction {
-	return newrelic.FromContext(ctx)
+	if txn := newrelic.FromContext(ctx); txn != nil {
+		return txn
+	}
+	return transactionFromContext(ctx)
+}
+
+// newrelicExternalSegment allows changing the library of the newrelic.ExternalSegment before it ends
+type newrelicExternalSegment struct {
+	*newrelic.ExternalSegment
+}
+
+func (s newrelicExternalSegment) setLibrary(library string) {
+	s.Library = library
+}
+
+func toNewRelicTransaction(txn Transaction) *newrelic.Transaction {
+	t, _ := txn.(*newrelic.Transaction)
+	return t
+}
+
+// startSegment starts a segment of the transaction, with its own segments when it has some
+func startSegment(txn Transaction, name string) Segment {
+	if s, ok := txn.(segmentStarter); ok {
+		return s.startSegment(name)
+	}
+	return txn.StartSegment(name)
+}
+
+// startGoroutineSegment starts the segment on a new goroutine of the newrelic transaction, so it is not dropped when
+// the segments open when it starts end before it. The other transactions start it as usual.
+func startGoroutineSegment(txn Transaction, name string) Segment {
+	if t := toNewRelicTransaction(txn); t != nil {
+		return t.NewGoroutine().StartSegment(name)
+	}
+	return startSegment(txn, name)
+}
+
+// startRPCSegment starts the segment of an RPC call with the transaction manager when it starts its own,
+// and as a newrelic external segment otherwise
+func startRPCSegment(txn Transaction, library, host, procedure string) Segment {
+	if s, ok := app.TransactionManager.(RPCSegmentStarter); ok {
+		return s.StartRPCSegment(txn, library, host, procedure)
+	}
+	return &newrelic.ExternalSegment{
+		StartTime: txn.StartSegmentNow(),
+		Library:   library,
+		Host:      host,
+		Procedure: procedure,
+	}
+}
+
+// addAttribute adds the attribute to the transaction when it supports attributes
+func addAttribute(txn Transaction, key string, value interface{}) {
+	if a, ok := txn.(AttributeAdder); ok {
+		a.AddAttribute(key, value)
+	}
+}
+
+// noticeError notices the error on the transaction when it supports errors
+func noticeError(txn Transaction, err error) {
+	if n, ok := txn.(ErrorNoticer); ok {
+		n.NoticeError(err)
+	}
+}
+
+// ignoreTransaction ignores the transaction when it can be ignored
+func ignoreTransaction(txn Transaction) {
+	if i, ok := txn.(TransactionIgnorer); ok {
+		i.Ignore()
+	}
 }
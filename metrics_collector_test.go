@@ -2,11 +2,22 @@
 package metrics
 
 import (
+	"context"
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/golang/mock/gomock"
+	"github.com/jbactad/krakend-newrelic-v2/collectortest"
 	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/encoding"
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/newrelic/go-agent/v3/newrelic"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -45,6 +56,27 @@ func TestNewApp(t *testing.T) {
 			},
 			wantErr: assert.NoError,
 		},
+		{
+			name: "given a hash_key, it should hash the values with it",
+			args: args{
+				cfg: map[string]interface{}{
+					Namespace: map[string]interface{}{
+						"hash_key": "s3cr3t",
+					},
+				},
+				nrFactory: func() (NRApplication, error) {
+					return NewMockNRApplication(ctrl), nil
+				},
+				transactionManager: NewMockTransactionManager(ctrl),
+			},
+			want: &Application{
+				TransactionManager: NewMockTransactionManager(ctrl),
+				NRApplication:      NewMockNRApplication(ctrl),
+				Config:             Config{HashKey: "s3cr3t"},
+				hashKey:            []byte("s3cr3t"),
+			},
+			wantErr: assert.NoError,
+		},
 		{
 			name: "given error while creating newrelic app, it should return the error",
 			args: args{
@@ -88,6 +120,72 @@ func TestNewApp(t *testing.T) {
 			want:    nil,
 			wantErr: assert.Error,
 		},
+		{
+			name: "given invalid connection config, it should return an error",
+			args: args{
+				cfg: map[string]interface{}{
+					Namespace: map[string]interface{}{
+						"connection": map[string]interface{}{
+							"timeout": "soon",
+						},
+					},
+				},
+				nrFactory: func() (NRApplication, error) {
+					return NewMockNRApplication(ctrl), nil
+				},
+			},
+			want:    nil,
+			wantErr: assert.Error,
+		},
+		{
+			name: "given an unknown claim redaction, it should return an error",
+			args: args{
+				cfg: map[string]interface{}{
+					Namespace: map[string]interface{}{
+						"auth": map[string]interface{}{
+							"redact": map[string]interface{}{"sub": "encrypt"},
+						},
+					},
+				},
+				nrFactory: func() (NRApplication, error) {
+					return NewMockNRApplication(ctrl), nil
+				},
+			},
+			want:    nil,
+			wantErr: assert.Error,
+		},
+		{
+			name: "given an api_key_header without hash_key, it should return an error",
+			args: args{
+				cfg: map[string]interface{}{
+					Namespace: map[string]interface{}{
+						"client": map[string]interface{}{"api_key_header": "X-Api-Key"},
+					},
+				},
+				nrFactory: func() (NRApplication, error) {
+					return NewMockNRApplication(ctrl), nil
+				},
+			},
+			want:    nil,
+			wantErr: assert.Error,
+		},
+		{
+			name: "given a hash redaction without hash_key, it should return an error",
+			args: args{
+				cfg: map[string]interface{}{
+					Namespace: map[string]interface{}{
+						"auth": map[string]interface{}{
+							"redact": map[string]interface{}{"sub": "hash"},
+						},
+					},
+				},
+				nrFactory: func() (NRApplication, error) {
+					return NewMockNRApplication(ctrl), nil
+				},
+			},
+			want:    nil,
+			wantErr: assert.Error,
+		},
 		{
 			name: "given json marshaller error, it should return an error",
 			args: args{
@@ -119,3 +217,176 @@ func TestNewApp(t *testing.T) {
 		)
 	}
 }
+
+func TestRegister_collector(t *testing.T) {
+	collector := collectortest.NewCollector()
+	defer collector.Close()
+	defer func() { app = nil }()
+
+	cfg := config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"rate": 100,
+		},
+	}
+	nrApp := Register(
+		context.Background(), cfg, logging.NoOp,
+		newrelic.ConfigAppName("krakend"),
+		newrelic.ConfigDistributedTracerEnabled(true),
+		collector.ConfigOption(),
+	)
+	if !assert.NotNil(t, nrApp) {
+		return
+	}
+	assert.True(t, Ready())
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL + "/users")
+
+	bf := BackendFactory("backend", proxy.HTTPProxyFactory(backend.Client()))
+	p := NewProxyMiddleware("(proxy) /users")(bf(&config.Backend{Decoder: encoding.NoOpDecoder}))
+	handlerFactory := HandlerFactory(
+		func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+			return func(c *gin.Context) {
+				_, err := p(c, &proxy.Request{Method: http.MethodGet, URL: backendURL, Headers: map[string][]string{}})
+				if err != nil {
+					c.AbortWithStatus(http.StatusBadGateway)
+					return
+				}
+				c.Status(http.StatusOK)
+			}
+		},
+	)
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(Middleware())
+	engine.GET("/users", handlerFactory(&config.EndpointConfig{Method: http.MethodGet, Endpoint: "/users"}, p))
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users", nil))
+
+	nrApp.Shutdown(5 * time.Second)
+
+	txnEvents, err := collector.TransactionEvents()
+	if assert.NoError(t, err) && assert.Len(t, txnEvents, 1) {
+		assert.Equal(t, "WebTransaction/Go/users", txnEvents[0].Intrinsics["name"])
+	}
+
+	spanEvents, err := collector.SpanEvents()
+	if assert.NoError(t, err) {
+		var names []interface{}
+		for _, event := range spanEvents {
+			names = append(names, event.Intrinsics["name"])
+		}
+		assert.Contains(t, names, "Custom/(proxy) /users")
+		assert.Contains(t, names, "External/"+backendURL.Host+"/http/GET")
+	}
+}
+
+// mockTransaction is a MockTransaction also adding attributes, noticing errors and being ignored
+type mockTransaction struct {
+	*MockTransaction
+	attributes *MockAttributeAdder
+	errors     *MockErrorNoticer
+	ignorer    *MockTransactionIgnorer
+}
+
+func newMockTransaction(ctrl *gomock.Controller) *mockTransaction {
+	return &mockTransaction{
+		MockTransaction: NewMockTransaction(ctrl),
+		attributes:      NewMockAttributeAdder(ctrl),
+		errors:          NewMockErrorNoticer(ctrl),
+		ignorer:         NewMockTransactionIgnorer(ctrl),
+	}
+}
+
+func (t *mockTransaction) AddAttribute(key string, value interface{}) {
+	t.attributes.AddAttribute(key, value)
+}
+
+func (t *mockTransaction) NoticeError(err error) {
+	t.errors.NoticeError(err)
+}
+
+func (t *mockTransaction) Ignore() {
+	t.ignorer.Ignore()
+}
+
+// mockRPCTransactionManager is a MockTransactionManager also starting the segments of the RPC calls
+type mockRPCTransactionManager struct {
+	*MockTransactionManager
+	rpc *MockRPCSegmentStarter
+}
+
+func newMockRPCTransactionManager(ctrl *gomock.Controller) *mockRPCTransactionManager {
+	return &mockRPCTransactionManager{
+		MockTransactionManager: NewMockTransactionManager(ctrl),
+		rpc:                    NewMockRPCSegmentStarter(ctrl),
+	}
+}
+
+func (m *mockRPCTransactionManager) StartRPCSegment(txn Transaction, library, host, procedure string) Segment {
+	return m.rpc.StartRPCSegment(txn, library, host, procedure)
+}
+
+func TestTransaction_capabilities(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	_, recorded := NewRecorder().StartTransactionContext(context.Background(), "txn")
+
+	tests := []struct {
+		name string
+		txn  Transaction
+		want bool
+	}{
+		{
+			name: "given a newrelic transaction, it should implement the optional capabilities",
+			txn:  (*newrelic.Transaction)(nil),
+			want: true,
+		},
+		{
+			name: "given a recorded transaction, it should implement the optional capabilities",
+			txn:  recorded,
+			want: true,
+		},
+		{
+			name: "given a transaction implementing the Transaction interface only, it should not implement them",
+			txn:  NewMockTransaction(ctrl),
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				_, attributes := tt.txn.(AttributeAdder)
+				_, noticer := tt.txn.(ErrorNoticer)
+				_, ignorer := tt.txn.(TransactionIgnorer)
+				assert.Equal(t, tt.want, attributes)
+				assert.Equal(t, tt.want, noticer)
+				assert.Equal(t, tt.want, ignorer)
+			},
+		)
+	}
+}
+
+func Test_startRPCSegment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer func() { app = nil }()
+
+	tx := NewMockTransaction(ctrl)
+	tx.EXPECT().StartSegmentNow().Return(newrelic.SegmentStartTime{}).AnyTimes()
+
+	app = &Application{TransactionManager: NewMockTransactionManager(ctrl)}
+	segment := startRPCSegment(tx, "gRPC", "grpc-backend:50051", "pkg.Service/Method")
+	assert.Equal(
+		t,
+		&newrelic.ExternalSegment{Library: "gRPC", Host: "grpc-backend:50051", Procedure: "pkg.Service/Method"},
+		segment,
+	)
+
+	tm := newMockRPCTransactionManager(ctrl)
+	seg := NewMockSegment(ctrl)
+	tm.rpc.EXPECT().StartRPCSegment(tx, "gRPC", "grpc-backend:50051", "pkg.Service/Method").Return(seg)
+	app = &Application{TransactionManager: tm}
+	assert.Equal(t, seg, startRPCSegment(tx, "gRPC", "grpc-backend:50051", "pkg.Service/Method"))
+}
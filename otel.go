@@ -0,0 +1,452 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/newrelic/go-agent/v3/newrelic"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// ExporterNewRelic sends the data with the NewRelic Go agent
+	ExporterNewRelic = "newrelic"
+	// ExporterOTLP sends the traces with the OpenTelemetry SDK using OTLP
+	ExporterOTLP = "otlp"
+
+	defaultOTLPEndpoint = "otlp.nr-data.net:4318"
+	defaultServiceName  = "krakend"
+	instrumentationName = "github.com/jbactad/krakend-newrelic-v2"
+)
+
+// OTLPConfig configures the OTLP exporter used when the exporter is otlp
+type OTLPConfig struct {
+	Endpoint    string            `json:"endpoint"`
+	Insecure    bool              `json:"insecure"`
+	Headers     map[string]string `json:"headers"`
+	ServiceName string            `json:"service_name"`
+}
+
+// NewOTLPExporter creates the OTLP exporter from the config.
+// The NewRelic license key and application name are read from the environment when they are not configured.
+func NewOTLPExporter(ctx context.Context, cfg OTLPConfig) (sdktrace.SpanExporter, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = defaultOTLPEndpoint
+	}
+	headers := make(map[string]string, len(cfg.Headers)+1)
+	for k, v := range cfg.Headers {
+		headers[k] = v
+	}
+	if _, ok := headers["api-key"]; !ok {
+		if key := os.Getenv("NEW_RELIC_LICENSE_KEY"); key != "" {
+			headers["api-key"] = key
+		}
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(endpoint),
+		otlptracehttp.WithHeaders(headers),
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	return otlptracehttp.New(ctx, opts...)
+}
+
+func otlpServiceName(cfg OTLPConfig) string {
+	if cfg.ServiceName != "" {
+		return cfg.ServiceName
+	}
+	if name := os.Getenv("NEW_RELIC_APP_NAME"); name != "" {
+		return name
+	}
+	return defaultServiceName
+}
+
+// OTelApplication implements NRApplication and TransactionManager with the OpenTelemetry SDK.
+// Transactions are server spans started by its gin middleware, and segments are their child spans.
+// Custom events, custom metrics and logs are not exported.
+type OTelApplication struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	processor  *transactionSpanProcessor
+}
+
+// NewOTelApplication creates an OTelApplication exporting the spans with the exporter
+func NewOTelApplication(serviceName string, exporter sdktrace.SpanExporter) *OTelApplication {
+	processor := &transactionSpanProcessor{
+		next:         sdktrace.NewBatchSpanProcessor(exporter),
+		transactions: map[trace.SpanID]*pendingTransaction{},
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(
+			resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName)),
+		),
+	)
+
+	return &OTelApplication{
+		provider:   provider,
+		tracer:     provider.Tracer(instrumentationName),
+		propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+		processor:  processor,
+	}
+}
+
+// StartTransaction is not supported, NewRelic transactions are not available with the OpenTelemetry SDK
+func (a *OTelApplication) StartTransaction(string, ...newrelic.TraceOption) *newrelic.Transaction {
+	return nil
+}
+
+func (a *OTelApplication) RecordCustomEvent(string, map[string]interface{}) {}
+
+func (a *OTelApplication) RecordCustomMetric(string, float64) {}
+
+func (a *OTelApplication) RecordLog(newrelic.LogData) {}
+
+func (a *OTelApplication) WaitForConnection(time.Duration) error {
+	return nil
+}
+
+func (a *OTelApplication) Shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_ = a.provider.Shutdown(ctx)
+}
+
+func (a *OTelApplication) TransactionFromContext(ctx context.Context) Transaction {
+	return transactionFromContext(ctx)
+}
+
+func (a *OTelApplication) StartExternalSegment(txn Transaction, request *http.Request) TransactionEndStatusCodeSetter {
+	t, ok := txn.(*otelTransaction)
+	if !ok {
+		return noopSegment{}
+	}
+
+	ctx, span := a.tracer.Start(
+		t.ctx,
+		fmt.Sprintf("External/%s/http/%s", request.URL.Host, request.Method),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(request.Method),
+			semconv.HTTPURLKey.String(request.URL.String()),
+			semconv.NetPeerNameKey.String(request.URL.Hostname()),
+		),
+	)
+	if request.Header != nil {
+		a.propagator.Inject(ctx, propagation.HeaderCarrier(request.Header))
+	}
+
+	return &otelSegment{span: span, host: request.URL.Host, method: request.Method}
+}
+
+func (a *OTelApplication) StartRPCSegment(txn Transaction, library, host, procedure string) Segment {
+	t, ok := txn.(*otelTransaction)
+	if !ok {
+		return noopSegment{}
+	}
+
+	service, method := splitProcedure(procedure)
+	_, span := a.tracer.Start(
+		t.ctx,
+		procedure,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.RPCSystemKey.String(strings.ToLower(library)),
+			semconv.RPCServiceKey.String(service),
+			semconv.RPCMethodKey.String(method),
+			semconv.NetPeerNameKey.String(host),
+		),
+	)
+
+	return &otelSegment{span: span}
+}
+
+// StartTransactionContext starts a background transaction and returns a context holding it
+func (a *OTelApplication) StartTransactionContext(ctx context.Context, name string) (context.Context, Transaction) {
+	txn := a.startTransaction(ctx, name, trace.SpanKindInternal)
+	return contextWithTransaction(txn.ctx, txn), txn
+}
+
+// GinMiddleware starts a transaction for every request, continuing the trace of the incoming trace headers
+func (a *OTelApplication) GinMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := a.propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		txn := a.startTransaction(ctx, c.Request.Method+" "+c.FullPath(), trace.SpanKindServer)
+		txn.SetWebRequestHTTP(c.Request)
+		defer txn.End()
+
+		c.Request = c.Request.WithContext(contextWithTransaction(c.Request.Context(), txn))
+		c.Set(ginTransactionKey, txn)
+		c.Next()
+
+		txn.setStatusCode(c.Writer.Status())
+	}
+}
+
+func (a *OTelApplication) startTransaction(ctx context.Context, name string, kind trace.SpanKind) *otelTransaction {
+	ctx, span := a.tracer.Start(ctx, name, trace.WithSpanKind(kind))
+	// the processor never sees the end of the spans not recorded, e.g. of an unsampled parent, so they are not held
+	if span.IsRecording() {
+		a.processor.begin(span.SpanContext().SpanID())
+	}
+
+	return &otelTransaction{app: a, ctx: ctx, span: span}
+}
+
+type otelTransaction struct {
+	app  *OTelApplication
+	ctx  context.Context
+	span trace.Span
+}
+
+func (t *otelTransaction) End() {
+	t.span.End()
+}
+
+func (t *otelTransaction) SetName(name string) {
+	t.span.SetName(name)
+}
+
+func (t *otelTransaction) SetWebRequestHTTP(r *http.Request) {
+	if r == nil {
+		return
+	}
+	t.span.SetAttributes(
+		semconv.HTTPMethodKey.String(r.Method),
+		semconv.HTTPTargetKey.String(r.URL.RequestURI()),
+		semconv.HTTPHostKey.String(r.Host),
+		semconv.HTTPUserAgentKey.String(r.UserAgent()),
+	)
+}
+
+func (t *otelTransaction) SetWebRequest(r newrelic.WebRequest) {
+	t.span.SetAttributes(semconv.HTTPMethodKey.String(r.Method), semconv.HTTPHostKey.String(r.Host))
+	if r.URL != nil {
+		t.span.SetAttributes(semconv.HTTPTargetKey.String(r.URL.RequestURI()))
+	}
+}
+
+func (t *otelTransaction) SetWebResponse(w http.ResponseWriter) http.ResponseWriter {
+	return &otelResponseWriter{ResponseWriter: w, txn: t}
+}
+
+func (t *otelTransaction) StartSegmentNow() newrelic.SegmentStartTime {
+	return newrelic.SegmentStartTime{}
+}
+
+// StartSegment returns a newrelic segment, which is not exported. The segments are started by startSegment.
+func (t *otelTransaction) StartSegment(name string) *newrelic.Segment {
+	return &newrelic.Segment{StartTime: t.StartSegmentNow(), Name: name}
+}
+
+func (t *otelTransaction) startSegment(name string) Segment {
+	_, span := t.app.tracer.Start(t.ctx, name)
+	return &otelSegment{span: span}
+}
+
+func (t *otelTransaction) InsertDistributedTraceHeaders(hdrs http.Header) {
+	t.app.propagator.Inject(t.ctx, propagation.HeaderCarrier(hdrs))
+}
+
+func (t *otelTransaction) NoticeError(err error) {
+	if err == nil {
+		return
+	}
+
+	var nrErr newrelic.Error
+	if errors.As(err, &nrErr) {
+		for k, v := range nrErr.Attributes {
+			t.span.SetAttributes(toAttribute(k, v))
+		}
+		if nrErr.Class != "" {
+			t.span.SetAttributes(attribute.String("error.class", nrErr.Class))
+		}
+	}
+	t.span.RecordError(err)
+	t.span.SetStatus(codes.Error, err.Error())
+}
+
+func (t *otelTransaction) AddAttribute(key string, value interface{}) {
+	t.span.SetAttributes(toAttribute(key, value))
+}
+
+func (t *otelTransaction) Ignore() {
+	t.app.processor.ignore(t.span.SpanContext().SpanID())
+}
+
+// NewGoroutine returns nil, the transaction can be used from any goroutine
+func (t *otelTransaction) NewGoroutine() *newrelic.Transaction {
+	return nil
+}
+
+func (t *otelTransaction) GetTraceMetadata() newrelic.TraceMetadata {
+	sc := t.span.SpanContext()
+	return newrelic.TraceMetadata{TraceID: sc.TraceID().String(), SpanID: sc.SpanID().String()}
+}
+
+func (t *otelTransaction) GetLinkingMetadata() newrelic.LinkingMetadata {
+	sc := t.span.SpanContext()
+	hostname, _ := os.Hostname()
+	return newrelic.LinkingMetadata{
+		TraceID:  sc.TraceID().String(),
+		SpanID:   sc.SpanID().String(),
+		Hostname: hostname,
+	}
+}
+
+func (t *otelTransaction) setStatusCode(code int) {
+	t.span.SetAttributes(semconv.HTTPStatusCodeKey.Int(code))
+	if code >= http.StatusInternalServerError {
+		t.span.SetStatus(codes.Error, http.StatusText(code))
+	}
+}
+
+type otelResponseWriter struct {
+	http.ResponseWriter
+	txn *otelTransaction
+}
+
+func (w *otelResponseWriter) WriteHeader(code int) {
+	w.txn.setStatusCode(code)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+type otelSegment struct {
+	span trace.Span
+	// host and method are only set for the external segments
+	host   string
+	method string
+}
+
+func (s *otelSegment) setLibrary(library string) {
+	if s.host == "" {
+		return
+	}
+	s.span.SetName(fmt.Sprintf("External/%s/%s/%s", s.host, library, s.method))
+}
+
+func (s *otelSegment) End() {
+	s.span.End()
+}
+
+func (s *otelSegment) AddAttribute(key string, val interface{}) {
+	s.span.SetAttributes(toAttribute(key, val))
+}
+
+func (s *otelSegment) SetStatusCode(code int) {
+	s.span.SetAttributes(semconv.HTTPStatusCodeKey.Int(code))
+	if code >= http.StatusBadRequest {
+		s.span.SetStatus(codes.Error, http.StatusText(code))
+	}
+}
+
+type noopSegment struct{}
+
+func (noopSegment) End() {}
+
+func (noopSegment) AddAttribute(string, interface{}) {}
+
+func (noopSegment) SetStatusCode(int) {}
+
+func toAttribute(key string, value interface{}) attribute.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case float64:
+		return attribute.Float64(key, v)
+	}
+	return attribute.String(key, fmt.Sprint(value))
+}
+
+type pendingTransaction struct {
+	ignored bool
+	spans   []sdktrace.ReadOnlySpan
+}
+
+// transactionSpanProcessor holds the spans of a transaction until the transaction ends,
+// so the spans of the ignored transactions are never exported.
+type transactionSpanProcessor struct {
+	next         sdktrace.SpanProcessor
+	mu           sync.Mutex
+	transactions map[trace.SpanID]*pendingTransaction
+}
+
+func (p *transactionSpanProcessor) begin(id trace.SpanID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.transactions[id] = &pendingTransaction{}
+}
+
+func (p *transactionSpanProcessor) ignore(id trace.SpanID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if txn, ok := p.transactions[id]; ok {
+		txn.ignored = true
+	}
+}
+
+func (p *transactionSpanProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	p.next.OnStart(parent, s)
+}
+
+func (p *transactionSpanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	p.mu.Lock()
+	if txn, ok := p.transactions[s.Parent().SpanID()]; ok {
+		txn.spans = append(txn.spans, s)
+		p.mu.Unlock()
+		return
+	}
+
+	txn, ok := p.transactions[s.SpanContext().SpanID()]
+	if !ok {
+		p.mu.Unlock()
+		p.next.OnEnd(s)
+		return
+	}
+	delete(p.transactions, s.SpanContext().SpanID())
+	p.mu.Unlock()
+
+	if txn.ignored {
+		return
+	}
+	for _, span := range txn.spans {
+		p.next.OnEnd(span)
+	}
+	p.next.OnEnd(s)
+}
+
+func (p *transactionSpanProcessor) Shutdown(ctx context.Context) error {
+	return p.next.Shutdown(ctx)
+}
+
+func (p *transactionSpanProcessor) ForceFlush(ctx context.Context) error {
+	return p.next.ForceFlush(ctx)
+}
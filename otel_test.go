@@ -0,0 +1,254 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestOTelApplication(t *testing.T) {
+	var receivedTraceparent string
+	backendServer := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				receivedTraceparent = r.Header.Get("Traceparent")
+				w.WriteHeader(http.StatusOK)
+			},
+		),
+	)
+	defer backendServer.Close()
+	backendURL, err := url.Parse(backendServer.URL + "/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		ignore    bool
+		wantSpans []string
+	}{
+		{
+			name:      "given a request, it should export the transaction and its segments as spans",
+			wantSpans: []string{"(proxy) /users", "External/" + backendURL.Host + "/http/GET", "/users"},
+		},
+		{
+			name:      "given the transaction is ignored, it should not export any span",
+			ignore:    true,
+			wantSpans: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				exporter := tracetest.NewInMemoryExporter()
+				otelApp := NewOTelApplication("krakend-test", exporter)
+				app = &Application{
+					TransactionManager: otelApp,
+					NRApplication:      otelApp,
+					Config:             Config{InstrumentationRate: 100},
+				}
+
+				backend := NewBackend(
+					"backend", func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+						req, err := http.NewRequestWithContext(ctx, request.Method, request.URL.String(), nil)
+						if err != nil {
+							return nil, err
+						}
+						req.Header = request.Headers
+						resp, err := http.DefaultClient.Do(req)
+						if err != nil {
+							return nil, err
+						}
+						defer resp.Body.Close()
+
+						return &proxy.Response{Metadata: proxy.Metadata{StatusCode: resp.StatusCode}}, nil
+					},
+				)
+				p := NewProxyMiddleware("(proxy) /users")(backend)
+				cfg := &config.EndpointConfig{Method: http.MethodGet, Endpoint: "/users"}
+				handler := HandlerFactory(
+					func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+						return func(c *gin.Context) {
+							_, _ = p(c, &proxy.Request{Method: http.MethodGet, URL: backendURL, Headers: map[string][]string{}})
+							if tt.ignore {
+								app.TransactionManager.TransactionFromContext(c).(TransactionIgnorer).Ignore()
+							}
+							c.Status(http.StatusOK)
+						}
+					},
+				)(cfg, p)
+
+				gin.SetMode(gin.TestMode)
+				w := httptest.NewRecorder()
+				_, e := gin.CreateTestContext(w)
+				e.Use(Middleware())
+				e.GET("/users", handler)
+				e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users", nil))
+
+				assert.NoError(t, otelApp.provider.ForceFlush(context.Background()))
+				spans := exporter.GetSpans()
+				names := make([]string, 0, len(spans))
+				for _, s := range spans {
+					names = append(names, s.Name)
+				}
+				assert.ElementsMatch(t, tt.wantSpans, names)
+				if tt.ignore {
+					return
+				}
+
+				txnSpan := spans[len(spans)-1]
+				assert.Equal(t, trace.SpanKindServer, txnSpan.SpanKind)
+				for _, s := range spans[:len(spans)-1] {
+					assert.Equal(t, txnSpan.SpanContext.SpanID(), s.Parent.SpanID())
+					assert.Equal(t, txnSpan.SpanContext.TraceID(), s.SpanContext.TraceID())
+				}
+				external := spans[0]
+				for _, s := range spans {
+					if s.SpanKind == trace.SpanKindClient {
+						external = s
+					}
+				}
+				assert.Equal(t, trace.SpanKindClient, external.SpanKind)
+				assert.Contains(t, receivedTraceparent, external.SpanContext.SpanID().String())
+			},
+		)
+	}
+}
+
+func Test_exporterFactory_droppedCustomData(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        Config
+		wantWarning string
+	}{
+		{
+			name: "given the otlp exporter with custom events and metrics, it should warn they are dropped",
+			conf: Config{
+				Exporter:             ExporterOTLP,
+				SlowRequestThreshold: "1s",
+				Streaming:            StreamingConfig{Enabled: true},
+				Client:               ClientConfig{Metrics: true},
+				Cache:                CacheConfig{Metrics: true},
+				PayloadSizes:         PayloadSizeConfig{Metrics: true},
+			},
+			wantWarning: "slow_request_threshold, streaming, client.metrics, cache.metrics, payload_sizes.metrics is dropped",
+		},
+		{
+			name: "given the otlp exporter without custom events and metrics, it should not warn",
+			conf: Config{Exporter: ExporterOTLP},
+		},
+		{
+			name: "given the NewRelic agent with custom events and metrics, it should not warn",
+			conf: Config{Streaming: StreamingConfig{Enabled: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				buf := &bytes.Buffer{}
+				logger, _ := logging.NewLogger("WARNING", buf, "")
+				exporterFactory(context.Background(), tt.conf, logger)
+				if tt.wantWarning == "" {
+					assert.Empty(t, buf.String())
+					return
+				}
+				assert.Contains(t, buf.String(), tt.wantWarning)
+			},
+		)
+	}
+}
+
+func TestOTelApplication_unsampledParent(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otelApp := NewOTelApplication("krakend-test", exporter)
+
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.Use(otelApp.GinMiddleware())
+	e.GET(
+		"/users", func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		},
+	)
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+		req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.NoError(t, otelApp.provider.ForceFlush(context.Background()))
+	assert.Empty(t, exporter.GetSpans())
+	otelApp.processor.mu.Lock()
+	defer otelApp.processor.mu.Unlock()
+	assert.Empty(t, otelApp.processor.transactions)
+}
+
+func Test_exporterFactory(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        Config
+		wantApp     interface{}
+		wantManager interface{}
+		wantErr     assert.ErrorAssertionFunc
+	}{
+		{
+			name:        "given no exporter, it should use the NewRelic agent",
+			conf:        Config{},
+			wantManager: newrelicWrapper{},
+			wantErr:     assert.NoError,
+		},
+		{
+			name:        "given the otlp exporter, it should use the OpenTelemetry SDK",
+			conf:        Config{Exporter: ExporterOTLP, OTLP: OTLPConfig{Endpoint: "localhost:4318", Insecure: true}},
+			wantApp:     &OTelApplication{},
+			wantManager: &OTelApplication{},
+			wantErr:     assert.NoError,
+		},
+		{
+			name:        "given the debug exporter, it should log the data",
+			conf:        Config{Exporter: ExporterDebug},
+			wantApp:     &DebugExporter{},
+			wantManager: &DebugExporter{},
+			wantErr:     assert.NoError,
+		},
+		{
+			name:    "given the debug exporter with an unknown format, it should return an error",
+			conf:    Config{Exporter: ExporterDebug, Debug: DebugConfig{Format: "yaml"}},
+			wantErr: assert.Error,
+		},
+		{
+			name:    "given an unknown exporter, it should return an error",
+			conf:    Config{Exporter: "unknown"},
+			wantErr: assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				factory, manager := exporterFactory(context.Background(), tt.conf, logging.NoOp)
+				if tt.wantManager != nil {
+					assert.IsType(t, tt.wantManager, manager)
+				}
+				if tt.wantApp == nil && tt.wantManager != nil {
+					return
+				}
+				nrApp, err := factory()
+				if !tt.wantErr(t, err) || tt.wantApp == nil {
+					return
+				}
+				assert.IsType(t, tt.wantApp, nrApp)
+			},
+		)
+	}
+}
@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/encoding"
+)
+
+// pendingStreamsKey is the key of the backend bodies streamed to the client by the no-op endpoints
+const pendingStreamsKey = "krakendNewRelicPendingStreams"
+
+// pendingStreams holds the backend bodies streamed during a request, so their segments end with the request
+// even when the client goes away before the end of the body
+type pendingStreams struct {
+	mu     sync.Mutex
+	bodies []*streamedBody
+}
+
+func (s *pendingStreams) add(body *streamedBody) {
+	s.mu.Lock()
+	s.bodies = append(s.bodies, body)
+	s.mu.Unlock()
+}
+
+func (s *pendingStreams) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, body := range s.bodies {
+		body.finish()
+	}
+}
+
+func pendingStreamsFromContext(ctx context.Context) *pendingStreams {
+	s, _ := ctx.Value(pendingStreamsKey).(*pendingStreams)
+	return s
+}
+
+// streamedBody measures a backend body streamed to the client as a segment,
+// ending when the body is read to the end, closed or when the request is done.
+type streamedBody struct {
+	n int64
+	io.Reader
+	segment Segment
+	once    sync.Once
+	onEnd   func(n int64)
+}
+
+func (b *streamedBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	if err != nil {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *streamedBody) Close() error {
+	defer b.finish()
+	if c, ok := b.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (b *streamedBody) finish() {
+	b.once.Do(
+		func() {
+			n := atomic.LoadInt64(&b.n)
+			b.segment.AddAttribute("bytesStreamed", n)
+			b.segment.End()
+			if b.onEnd != nil {
+				b.onEnd(n)
+			}
+		},
+	)
+}
+
+// streamBackendBody wraps the body of a backend response streamed by the no-op encoding, timing its copy to the
+// client in a segment named (stream) {host}{url_pattern}, as the external segment ends before it is copied.
+// The segment is started on its own goroutine of the transaction, as it outlives the external segment open when
+// it starts. When the size of the response is not known, it is recorded once streamed.
+func streamBackendBody(
+	ctx context.Context,
+	txn Transaction,
+	body io.Reader,
+	host, urlPattern string,
+	sizeKnown bool,
+) io.Reader {
+	streamed := &streamedBody{
+		Reader:  body,
+		segment: startGoroutineSegment(txn, fmt.Sprintf("(stream) %s%s", host, urlPattern)),
+	}
+	if app.Config.PayloadSizes.Enabled && !sizeKnown {
+		streamed.onEnd = func(n int64) {
+			streamed.segment.AddAttribute("response.bodySize", n)
+			if app.Config.PayloadSizes.Metrics {
+				app.RecordCustomMetric(backendResponseSizeMetric+host+urlPattern, float64(n))
+			}
+		}
+	}
+	if streams := pendingStreamsFromContext(ctx); streams != nil {
+		streams.add(streamed)
+	}
+	return streamed
+}
+
+// isPassthroughEndpoint tells whether the endpoint streams the backend response with the no-op encoding
+func isPassthroughEndpoint(outputEncoding string) bool {
+	return outputEncoding == encoding.NOOP
+}
+
+// streamingResponseWriter notes when the response body starts being written
+type streamingResponseWriter struct {
+	gin.ResponseWriter
+	firstWrite time.Time
+}
+
+func (w *streamingResponseWriter) Write(b []byte) (int, error) {
+	if w.firstWrite.IsZero() {
+		w.firstWrite = time.Now()
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *streamingResponseWriter) WriteString(s string) (int, error) {
+	if w.firstWrite.IsZero() {
+		w.firstWrite = time.Now()
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// recordStreamedResponse adds the time to the first byte of the response, the time spent streaming it and the bytes
+// streamed to the transaction of a no-op endpoint
+func recordStreamedResponse(txn Transaction, w *streamingResponseWriter, start, end time.Time) {
+	size := int64(w.Size())
+	if size < 0 {
+		size = 0
+	}
+	addAttribute(txn, "response.bytesStreamed", size)
+	if w.firstWrite.IsZero() {
+		return
+	}
+	addAttribute(txn, "response.timeToFirstByteMs", w.firstWrite.Sub(start).Milliseconds())
+	addAttribute(txn, "response.streamingMs", end.Sub(w.firstWrite).Milliseconds())
+}
@@ -0,0 +1,250 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jbactad/krakend-newrelic-v2/collectortest"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/encoding"
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/newrelic/go-agent/v3/newrelic"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerFactory_passthrough(t *testing.T) {
+	tests := []struct {
+		name                  string
+		payloadSizes          PayloadSizeConfig
+		headers               map[string][]string
+		copyBody              bool
+		wantAttributes        map[string]interface{}
+		wantSegmentAttributes map[string]interface{}
+		wantMetrics           []float64
+	}{
+		{
+			name:     "given a streamed backend body, it should time its streaming separately",
+			copyBody: true,
+			wantAttributes: map[string]interface{}{
+				"response.bytesStreamed": int64(12),
+			},
+			wantSegmentAttributes: map[string]interface{}{"bytesStreamed": int64(12)},
+			wantMetrics:           []float64{},
+		},
+		{
+			name:         "given payload sizes are enabled, it should record the size of the streamed body",
+			payloadSizes: PayloadSizeConfig{Enabled: true, Metrics: true},
+			copyBody:     true,
+			wantAttributes: map[string]interface{}{
+				"response.bytesStreamed": int64(12),
+			},
+			wantSegmentAttributes: map[string]interface{}{
+				"bytesStreamed":     int64(12),
+				"response.bodySize": int64(12),
+			},
+			wantMetrics: []float64{12},
+		},
+		{
+			name:         "given the size of the body is known, it should not record it again",
+			payloadSizes: PayloadSizeConfig{Enabled: true, Metrics: true},
+			headers:      map[string][]string{"Content-Length": {"12"}},
+			copyBody:     true,
+			wantAttributes: map[string]interface{}{
+				"response.bytesStreamed": int64(12),
+			},
+			wantSegmentAttributes: map[string]interface{}{"bytesStreamed": int64(12)},
+			wantMetrics:           []float64{12},
+		},
+		{
+			name: "given the body is not copied, it should end the stream segment with the request",
+			wantAttributes: map[string]interface{}{
+				"response.bytesStreamed": int64(0),
+			},
+			wantSegmentAttributes: map[string]interface{}{"bytesStreamed": int64(0)},
+			wantMetrics:           []float64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				recorder := NewRecorder()
+				app = &Application{
+					TransactionManager: recorder,
+					NRApplication:      recorder,
+					Config:             Config{InstrumentationRate: 100, PayloadSizes: tt.payloadSizes},
+				}
+				defer func() { app = nil }()
+
+				backendURL, _ := url.Parse("http://backend:8080/users")
+				bf := BackendFactory(
+					"backend", func(*config.Backend) proxy.Proxy {
+						return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+							return &proxy.Response{
+								Io:       strings.NewReader("hello gopher"),
+								Metadata: proxy.Metadata{StatusCode: http.StatusOK, Headers: tt.headers},
+							}, nil
+						}
+					},
+				)
+				p := bf(&config.Backend{URLPattern: "/users"})
+				handler := HandlerFactory(
+					func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+						return func(c *gin.Context) {
+							resp, err := p(c, &proxy.Request{Method: http.MethodGet, URL: backendURL, Headers: map[string][]string{}})
+							if err != nil {
+								return
+							}
+							c.Status(resp.Metadata.StatusCode)
+							if tt.copyBody {
+								_, _ = io.Copy(c.Writer, resp.Io)
+							}
+						}
+					},
+				)(&config.EndpointConfig{Method: http.MethodGet, Endpoint: "/users", OutputEncoding: encoding.NOOP}, p)
+
+				gin.SetMode(gin.TestMode)
+				e := gin.New()
+				e.Use(Middleware())
+				e.GET("/users", handler)
+				w := httptest.NewRecorder()
+				e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users", nil))
+
+				txn, ok := recorder.Transaction("/users")
+				if !assert.True(t, ok) {
+					return
+				}
+				for k, v := range tt.wantAttributes {
+					assert.Equal(t, v, txn.Attributes[k], k)
+				}
+				if tt.copyBody {
+					assert.Equal(t, "hello gopher", w.Body.String())
+					assert.Contains(t, txn.Attributes, "response.timeToFirstByteMs")
+					assert.Contains(t, txn.Attributes, "response.streamingMs")
+				}
+				assert.Equal(
+					t, []string{"External/backend:8080/http/GET", "(stream) backend:8080/users"}, txn.SegmentNames(),
+				)
+				segment, _ := txn.Segment("(stream) backend:8080/users")
+				assert.True(t, segment.Ended)
+				assert.Equal(t, tt.wantSegmentAttributes, segment.Attributes)
+				assert.Equal(t, tt.wantMetrics, recorder.Metrics("Custom/KrakenD/BackendResponseSize/backend:8080/users"))
+			},
+		)
+	}
+}
+
+func TestHandlerFactory_notPassthrough(t *testing.T) {
+	recorder := NewRecorder()
+	app = &Application{
+		TransactionManager: recorder,
+		NRApplication:      recorder,
+		Config:             Config{InstrumentationRate: 100},
+	}
+	defer func() { app = nil }()
+
+	handler := HandlerFactory(
+		func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+			return func(c *gin.Context) {
+				c.String(http.StatusOK, "hello")
+			}
+		},
+	)(&config.EndpointConfig{Method: http.MethodGet, Endpoint: "/users", OutputEncoding: encoding.JSON}, nil)
+
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.Use(Middleware())
+	e.GET("/users", handler)
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users", nil))
+
+	txn, ok := recorder.Transaction("/users")
+	if assert.True(t, ok) {
+		assert.NotContains(t, txn.Attributes, "response.bytesStreamed")
+	}
+}
+
+func TestHandlerFactory_passthroughCollector(t *testing.T) {
+	collector := collectortest.NewCollector()
+	defer collector.Close()
+	defer func() { app = nil }()
+
+	cfg := config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"rate": 100,
+		},
+	}
+	nrApp := Register(
+		context.Background(), cfg, logging.NoOp,
+		newrelic.ConfigAppName("krakend"),
+		newrelic.ConfigDistributedTracerEnabled(true),
+		collector.ConfigOption(),
+	)
+	if !assert.NotNil(t, nrApp) {
+		return
+	}
+
+	backend := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("streamed body"))
+			},
+		),
+	)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL + "/users")
+
+	bf := BackendFactory("backend", proxy.HTTPProxyFactory(backend.Client()))
+	p := bf(&config.Backend{URLPattern: "/users", Encoding: encoding.NOOP})
+	handlerFactory := HandlerFactory(
+		func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+			return func(c *gin.Context) {
+				resp, err := p(c, &proxy.Request{Method: http.MethodGet, URL: backendURL, Headers: map[string][]string{}})
+				if err != nil {
+					c.AbortWithStatus(http.StatusBadGateway)
+					return
+				}
+				c.Status(http.StatusOK)
+				_, _ = io.Copy(c.Writer, resp.Io)
+			}
+		},
+	)
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(Middleware())
+	engine.GET(
+		"/users",
+		handlerFactory(
+			&config.EndpointConfig{Method: http.MethodGet, Endpoint: "/users", OutputEncoding: encoding.NOOP}, p,
+		),
+	)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users", nil))
+	assert.Equal(t, "streamed body", w.Body.String())
+
+	nrApp.Shutdown(5 * time.Second)
+
+	spanEvents, err := collector.SpanEvents()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var names []interface{}
+	var stream *collectortest.Event
+	for i, event := range spanEvents {
+		names = append(names, event.Intrinsics["name"])
+		if event.Intrinsics["name"] == "Custom/(stream) "+backendURL.Host+"/users" {
+			stream = &spanEvents[i]
+		}
+	}
+	assert.Contains(t, names, "External/"+backendURL.Host+"/http/GET")
+	if assert.NotNil(t, stream, "the (stream) span is not sent") {
+		assert.Equal(t, float64(13), stream.UserAttributes["bytesStreamed"])
+	}
+}
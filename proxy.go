@@ -3,6 +3,7 @@ package metrics
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/luraproject/lura/v2/config"
 	"github.com/luraproject/lura/v2/proxy"
@@ -19,7 +20,7 @@ func ProxyFactory(segmentName string, next proxy.Factory) proxy.FactoryFunc {
 			if err != nil {
 				return proxy.NoopProxy, err
 			}
-			return NewProxyMiddleware(fmt.Sprintf("(%s) %s", segmentName, cfg.Endpoint))(next), nil
+			return newProxyMiddleware(fmt.Sprintf("(%s) %s", segmentName, cfg.Endpoint), cfg.Timeout)(next), nil
 		},
 	)
 }
@@ -29,6 +30,11 @@ func NewProxyMiddleware(segmentName string) proxy.Middleware {
 	if app == nil {
 		return proxy.EmptyMiddleware
 	}
+	return newProxyMiddleware(segmentName, 0)
+}
+
+// newProxyMiddleware adds the segment of the proxy, with the timeout of its endpoint
+func newProxyMiddleware(segmentName string, timeout time.Duration) proxy.Middleware {
 	return func(next ...proxy.Proxy) proxy.Proxy {
 		if len(next) > 1 {
 			panic(proxy.ErrTooManyProxies)
@@ -37,14 +43,26 @@ func NewProxyMiddleware(segmentName string) proxy.Middleware {
 			panic(proxy.ErrNotEnoughProxies)
 		}
 		return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
-			tx := app.TransactionManager.TransactionFromContext(ctx)
+			ctx, tx := transactionFor(ctx, req)
 			if tx == nil {
-				return next[0](ctx, req)
+				ctx, tx = startStandaloneTransaction(ctx, "Proxy/"+segmentName)
+				if tx == nil {
+					return next[0](ctx, req)
+				}
+				defer tx.End()
 			}
+			defer RequestWithTransaction(req, tx)()
 
-			segment := tx.StartSegment(segmentName)
+			if timeout > 0 {
+				addAttribute(tx, "endpoint.timeoutMs", timeout.Milliseconds())
+			}
+			segment := startSegment(tx, segmentName)
+			deadlineAttributes(ctx, segment, timeout)
 			resp, err := next[0](ctx, req)
 			defer segment.End()
+			if timeoutSource(ctx, err) == timeoutSourceGateway {
+				segment.AddAttribute("timeout.source", timeoutSourceGateway)
+			}
 
 			return resp, err
 		}
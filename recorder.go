@@ -0,0 +1,532 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// Recorder implements NRApplication and TransactionManager in memory.
+// It records the transactions, segments, attributes, errors, custom events, custom metrics and logs,
+// so the instrumentation of a gateway can be asserted without sending anything to NewRelic.
+type Recorder struct {
+	mu           sync.Mutex
+	ids          uint64
+	transactions []*RecordedTransaction
+	events       []RecordedEvent
+	metrics      []RecordedMetric
+	logs         []newrelic.LogData
+
+	onTransactionEnd func(txn *RecordedTransaction)
+}
+
+// RecordedTransaction is a transaction recorded by the Recorder
+type RecordedTransaction struct {
+	Name       string
+	TraceID    string
+	SpanID     string
+	Attributes map[string]interface{}
+	Errors     []error
+	Segments   []*RecordedSegment
+	StatusCode int
+	Ignored    bool
+	Ended      bool
+	Start      time.Time
+	Duration   time.Duration
+}
+
+// RecordedSegment is a segment recorded by the Recorder
+type RecordedSegment struct {
+	Name       string
+	SpanID     string
+	URL        string
+	Library    string
+	Host       string
+	Procedure  string
+	StatusCode int
+	Attributes map[string]interface{}
+	Ended      bool
+	Start      time.Time
+	Duration   time.Duration
+}
+
+// RecordedEvent is a custom event recorded by the Recorder
+type RecordedEvent struct {
+	Type   string
+	Params map[string]interface{}
+}
+
+// RecordedMetric is a custom metric recorded by the Recorder
+type RecordedMetric struct {
+	Name  string
+	Value float64
+}
+
+// NewRecorder creates an empty Recorder
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// StartTransaction is not supported, use StartTransactionContext to start a recorded transaction
+func (r *Recorder) StartTransaction(string, ...newrelic.TraceOption) *newrelic.Transaction {
+	return nil
+}
+
+// StartTransactionContext starts a recorded transaction and returns a context holding it
+func (r *Recorder) StartTransactionContext(ctx context.Context, name string) (context.Context, Transaction) {
+	txn := r.startTransaction(name)
+	return contextWithTransaction(ctx, txn), txn
+}
+
+func (r *Recorder) RecordCustomEvent(eventType string, params map[string]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, RecordedEvent{Type: eventType, Params: copyAttributes(params)})
+}
+
+func (r *Recorder) RecordCustomMetric(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, RecordedMetric{Name: name, Value: value})
+}
+
+func (r *Recorder) RecordLog(logEvent newrelic.LogData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.logs = append(r.logs, logEvent)
+}
+
+func (r *Recorder) WaitForConnection(time.Duration) error {
+	return nil
+}
+
+func (r *Recorder) Shutdown(time.Duration) {}
+
+func (r *Recorder) TransactionFromContext(ctx context.Context) Transaction {
+	return transactionFromContext(ctx)
+}
+
+func (r *Recorder) StartExternalSegment(txn Transaction, request *http.Request) TransactionEndStatusCodeSetter {
+	t, ok := txn.(*recorderTransaction)
+	if !ok {
+		return noopSegment{}
+	}
+
+	segment := t.newSegment(fmt.Sprintf("External/%s/http/%s", request.URL.Host, request.Method))
+	r.mu.Lock()
+	segment.segment.URL = request.URL.String()
+	segment.segment.Host = request.URL.Host
+	r.mu.Unlock()
+	if request.Header != nil {
+		request.Header.Set("Traceparent", t.traceparent(segment.segment.SpanID))
+	}
+
+	return segment
+}
+
+func (r *Recorder) StartRPCSegment(txn Transaction, library, host, procedure string) Segment {
+	t, ok := txn.(*recorderTransaction)
+	if !ok {
+		return noopSegment{}
+	}
+
+	segment := t.newSegment(procedure)
+	r.mu.Lock()
+	segment.segment.Library = library
+	segment.segment.Host = host
+	segment.segment.Procedure = procedure
+	r.mu.Unlock()
+
+	return segment
+}
+
+// GinMiddleware starts a recorded transaction for every request
+func (r *Recorder) GinMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		txn := r.startTransaction(c.Request.Method + " " + c.FullPath())
+		txn.SetWebRequestHTTP(c.Request)
+		defer txn.End()
+
+		c.Request = c.Request.WithContext(contextWithTransaction(c.Request.Context(), txn))
+		c.Set(ginTransactionKey, txn)
+		c.Next()
+
+		txn.setStatusCode(c.Writer.Status())
+	}
+}
+
+// Transactions returns a copy of the recorded transactions
+func (r *Recorder) Transactions() []RecordedTransaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]RecordedTransaction, 0, len(r.transactions))
+	for _, t := range r.transactions {
+		result = append(result, t.copy())
+	}
+	return result
+}
+
+// Transaction returns the first recorded transaction with the name
+func (r *Recorder) Transaction(name string) (RecordedTransaction, bool) {
+	for _, t := range r.Transactions() {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return RecordedTransaction{}, false
+}
+
+// Events returns the custom events recorded with the event type
+func (r *Recorder) Events(eventType string) []RecordedEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]RecordedEvent, 0)
+	for _, e := range r.events {
+		if e.Type == eventType {
+			result = append(result, RecordedEvent{Type: e.Type, Params: copyAttributes(e.Params)})
+		}
+	}
+	return result
+}
+
+// Metrics returns the values of the custom metric recorded with the name
+func (r *Recorder) Metrics(name string) []float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]float64, 0)
+	for _, m := range r.metrics {
+		if m.Name == name {
+			result = append(result, m.Value)
+		}
+	}
+	return result
+}
+
+// Logs returns the recorded logs
+func (r *Recorder) Logs() []newrelic.LogData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]newrelic.LogData, len(r.logs))
+	copy(result, r.logs)
+	return result
+}
+
+// Reset removes everything recorded so far
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.transactions = nil
+	r.events = nil
+	r.metrics = nil
+	r.logs = nil
+}
+
+// release removes the transaction from the recorder and returns a copy of it
+func (r *Recorder) release(txn *RecordedTransaction) RecordedTransaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, t := range r.transactions {
+		if t == txn {
+			r.transactions = append(r.transactions[:i], r.transactions[i+1:]...)
+			break
+		}
+	}
+	return txn.copy()
+}
+
+func (r *Recorder) nextID() string {
+	r.ids++
+	return fmt.Sprintf("%016x", r.ids)
+}
+
+func (r *Recorder) startTransaction(name string) *recorderTransaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	txn := &RecordedTransaction{
+		Name:       name,
+		TraceID:    r.nextID() + r.nextID(),
+		SpanID:     r.nextID(),
+		Attributes: map[string]interface{}{},
+		Start:      time.Now(),
+	}
+	r.transactions = append(r.transactions, txn)
+
+	return &recorderTransaction{recorder: r, txn: txn}
+}
+
+// SegmentNames returns the names of the segments of the transaction
+func (t RecordedTransaction) SegmentNames() []string {
+	result := make([]string, 0, len(t.Segments))
+	for _, s := range t.Segments {
+		result = append(result, s.Name)
+	}
+	return result
+}
+
+// Segment returns the first segment of the transaction with the name
+func (t RecordedTransaction) Segment(name string) (*RecordedSegment, bool) {
+	for _, s := range t.Segments {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+func (t *RecordedTransaction) copy() RecordedTransaction {
+	result := *t
+	result.Attributes = copyAttributes(t.Attributes)
+	result.Errors = append([]error(nil), t.Errors...)
+	result.Segments = make([]*RecordedSegment, 0, len(t.Segments))
+	for _, s := range t.Segments {
+		segment := *s
+		segment.Attributes = copyAttributes(s.Attributes)
+		result.Segments = append(result.Segments, &segment)
+	}
+	return result
+}
+
+func copyAttributes(attrs map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(attrs))
+	for k, v := range attrs {
+		result[k] = v
+	}
+	return result
+}
+
+type recorderTransaction struct {
+	recorder *Recorder
+	txn      *RecordedTransaction
+}
+
+func (t *recorderTransaction) update(f func(txn *RecordedTransaction)) {
+	t.recorder.mu.Lock()
+	defer t.recorder.mu.Unlock()
+
+	f(t.txn)
+}
+
+func (t *recorderTransaction) End() {
+	ended := false
+	t.update(
+		func(txn *RecordedTransaction) {
+			if txn.Ended {
+				return
+			}
+			txn.Ended = true
+			txn.Duration = time.Since(txn.Start)
+			ended = true
+		},
+	)
+	if ended && t.recorder.onTransactionEnd != nil {
+		t.recorder.onTransactionEnd(t.txn)
+	}
+}
+
+func (t *recorderTransaction) SetName(name string) {
+	t.update(
+		func(txn *RecordedTransaction) {
+			txn.Name = name
+		},
+	)
+}
+
+func (t *recorderTransaction) SetWebRequestHTTP(r *http.Request) {
+	if r == nil {
+		return
+	}
+	t.update(
+		func(txn *RecordedTransaction) {
+			txn.Attributes["request.method"] = r.Method
+			txn.Attributes["request.uri"] = r.URL.Path
+		},
+	)
+}
+
+func (t *recorderTransaction) SetWebRequest(r newrelic.WebRequest) {
+	t.update(
+		func(txn *RecordedTransaction) {
+			txn.Attributes["request.method"] = r.Method
+			if r.URL != nil {
+				txn.Attributes["request.uri"] = r.URL.Path
+			}
+		},
+	)
+}
+
+func (t *recorderTransaction) SetWebResponse(w http.ResponseWriter) http.ResponseWriter {
+	if w == nil {
+		w = httpResponseDiscarder{}
+	}
+	return &recorderResponseWriter{ResponseWriter: w, txn: t}
+}
+
+func (t *recorderTransaction) StartSegmentNow() newrelic.SegmentStartTime {
+	return newrelic.SegmentStartTime{}
+}
+
+// StartSegment returns a newrelic segment, which is not recorded. The segments are started by startSegment.
+func (t *recorderTransaction) StartSegment(name string) *newrelic.Segment {
+	return &newrelic.Segment{StartTime: t.StartSegmentNow(), Name: name}
+}
+
+func (t *recorderTransaction) startSegment(name string) Segment {
+	return t.newSegment(name)
+}
+
+func (t *recorderTransaction) newSegment(name string) *recorderSegment {
+	t.recorder.mu.Lock()
+	defer t.recorder.mu.Unlock()
+
+	segment := &RecordedSegment{
+		Name:       name,
+		SpanID:     t.recorder.nextID(),
+		Attributes: map[string]interface{}{},
+		Start:      time.Now(),
+	}
+	t.txn.Segments = append(t.txn.Segments, segment)
+
+	return &recorderSegment{recorder: t.recorder, segment: segment}
+}
+
+func (t *recorderTransaction) traceparent(spanID string) string {
+	t.recorder.mu.Lock()
+	defer t.recorder.mu.Unlock()
+
+	return fmt.Sprintf("00-%s-%s-01", t.txn.TraceID, spanID)
+}
+
+func (t *recorderTransaction) InsertDistributedTraceHeaders(hdrs http.Header) {
+	t.recorder.mu.Lock()
+	spanID := t.txn.SpanID
+	t.recorder.mu.Unlock()
+
+	hdrs.Set("Traceparent", t.traceparent(spanID))
+}
+
+func (t *recorderTransaction) NoticeError(err error) {
+	t.update(
+		func(txn *RecordedTransaction) {
+			txn.Errors = append(txn.Errors, err)
+		},
+	)
+}
+
+func (t *recorderTransaction) AddAttribute(key string, value interface{}) {
+	t.update(
+		func(txn *RecordedTransaction) {
+			txn.Attributes[key] = value
+		},
+	)
+}
+
+func (t *recorderTransaction) Ignore() {
+	t.update(
+		func(txn *RecordedTransaction) {
+			txn.Ignored = true
+		},
+	)
+}
+
+// NewGoroutine returns nil, the transaction can be used from any goroutine
+func (t *recorderTransaction) NewGoroutine() *newrelic.Transaction {
+	return nil
+}
+
+func (t *recorderTransaction) GetTraceMetadata() newrelic.TraceMetadata {
+	t.recorder.mu.Lock()
+	defer t.recorder.mu.Unlock()
+
+	return newrelic.TraceMetadata{TraceID: t.txn.TraceID, SpanID: t.txn.SpanID}
+}
+
+func (t *recorderTransaction) GetLinkingMetadata() newrelic.LinkingMetadata {
+	t.recorder.mu.Lock()
+	defer t.recorder.mu.Unlock()
+
+	return newrelic.LinkingMetadata{TraceID: t.txn.TraceID, SpanID: t.txn.SpanID}
+}
+
+func (t *recorderTransaction) setStatusCode(code int) {
+	t.update(
+		func(txn *RecordedTransaction) {
+			txn.StatusCode = code
+		},
+	)
+}
+
+type recorderResponseWriter struct {
+	http.ResponseWriter
+	txn *recorderTransaction
+}
+
+func (w *recorderResponseWriter) WriteHeader(code int) {
+	w.txn.setStatusCode(code)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+type httpResponseDiscarder struct{}
+
+func (httpResponseDiscarder) Header() http.Header {
+	return http.Header{}
+}
+
+func (httpResponseDiscarder) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (httpResponseDiscarder) WriteHeader(int) {}
+
+type recorderSegment struct {
+	recorder *Recorder
+	segment  *RecordedSegment
+}
+
+func (s *recorderSegment) End() {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+
+	if s.segment.Ended {
+		return
+	}
+	s.segment.Ended = true
+	s.segment.Duration = time.Since(s.segment.Start)
+}
+
+func (s *recorderSegment) AddAttribute(key string, val interface{}) {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+
+	s.segment.Attributes[key] = val
+}
+
+func (s *recorderSegment) setLibrary(library string) {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+
+	s.segment.Name = strings.Replace(s.segment.Name, "/http/", "/"+library+"/", 1)
+	s.segment.Library = library
+}
+
+func (s *recorderSegment) SetStatusCode(code int) {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+
+	s.segment.StatusCode = code
+}
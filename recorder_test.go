@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	recorder := NewRecorder()
+	app = &Application{
+		TransactionManager: recorder,
+		NRApplication:      recorder,
+		Config: Config{
+			InstrumentationRate: 100,
+			StatusCodes:         &StatusCodeClassification{},
+		},
+	}
+
+	backendURL, err := url.Parse("http://backend:8080/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sentTraceparent string
+	backend := NewBackend(
+		"backend", func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			sentTraceparent = http.Header(request.Headers).Get("Traceparent")
+			return nil, responseError(http.StatusBadGateway)
+		},
+	)
+	handler := HandlerFactory(
+		func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+			return func(c *gin.Context) {
+				_, _ = p(c, &proxy.Request{Method: http.MethodGet, URL: backendURL, Headers: map[string][]string{}})
+				app.RecordCustomEvent("Lookup", map[string]interface{}{"found": false})
+				app.RecordCustomMetric("Custom/Lookups", 1)
+				c.Status(http.StatusBadGateway)
+			}
+		},
+	)(&config.EndpointConfig{Method: http.MethodGet, Endpoint: "/users"}, NewProxyMiddleware("(proxy) /users")(backend))
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	_, e := gin.CreateTestContext(w)
+	e.Use(Middleware())
+	e.GET("/users", handler)
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users", nil))
+
+	txn, ok := recorder.Transaction("/users")
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.True(t, txn.Ended)
+	assert.Equal(t, http.StatusBadGateway, txn.StatusCode)
+	assert.Equal(t, []string{"(proxy) /users", "External/backend:8080/http/GET"}, txn.SegmentNames())
+	assert.Len(t, txn.Errors, 2)
+	assert.Equal(t, "GET", txn.Attributes["request.method"])
+
+	external, ok := txn.Segment("External/backend:8080/http/GET")
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.True(t, external.Ended)
+	assert.Equal(t, "http://backend:8080/users", external.URL)
+	assert.Equal(t, "00-"+txn.TraceID+"-"+external.SpanID+"-01", sentTraceparent)
+
+	assert.Equal(t, []RecordedEvent{{Type: "Lookup", Params: map[string]interface{}{"found": false}}}, recorder.Events("Lookup"))
+	assert.Equal(t, []float64{1}, recorder.Metrics("Custom/Lookups"))
+
+	recorder.Reset()
+	assert.Empty(t, recorder.Transactions())
+	assert.Empty(t, recorder.Events("Lookup"))
+}
+
+func TestRecorder_StartTransactionContext(t *testing.T) {
+	recorder := NewRecorder()
+	ctx, txn := recorder.StartTransactionContext(context.Background(), "background")
+	assert.Equal(t, txn, recorder.TransactionFromContext(ctx))
+
+	segment := recorder.StartRPCSegment(txn, "gRPC", "grpc-backend:50051", "pkg.Service/Method")
+	segment.AddAttribute("grpc.statusCode", 0)
+	segment.End()
+	txn.(ErrorNoticer).NoticeError(errors.New("failed"))
+	txn.(TransactionIgnorer).Ignore()
+	txn.End()
+
+	got, ok := recorder.Transaction("background")
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.True(t, got.Ignored)
+	assert.Equal(t, []error{errors.New("failed")}, got.Errors)
+	rpc, ok := got.Segment("pkg.Service/Method")
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, "gRPC", rpc.Library)
+	assert.Equal(t, "grpc-backend:50051", rpc.Host)
+	assert.Equal(t, map[string]interface{}{"grpc.statusCode": 0}, rpc.Attributes)
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/luraproject/lura/v2/transport/http/client"
+)
+
+const (
+	// retriesKey is the key of the retries of the backend calls made for a request
+	retriesKey = "krakendNewRelicRetries"
+
+	attemptOutcomeSuccess = "success"
+	attemptOutcomeFailure = "failure"
+	attemptOutcomeError   = "error"
+)
+
+// RetryConfig configures the instrumentation of the attempts of the backend calls
+type RetryConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// retryCounter sums the retries of the backend calls made for a request
+type retryCounter struct {
+	total int64
+}
+
+func (c *retryCounter) add(retries int64) int64 {
+	return atomic.AddInt64(&c.total, retries)
+}
+
+// RetryHTTPClientFactory wraps the http client factory of the backends, so every attempt of a backend call made
+// with the client, e.g. by a retrying client or proxy, is recorded as a segment named (attempt) {host}{url_pattern}.
+func RetryHTTPClientFactory(next client.HTTPClientFactory) client.HTTPClientFactory {
+	return func(ctx context.Context) *http.Client {
+		c := *next(ctx)
+		transport := c.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		c.Transport = retryRoundTripper{next: transport}
+		return &c
+	}
+}
+
+type retryRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (t retryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	call := backendCallFromContext(req.Context())
+	if call == nil || app == nil {
+		return t.next.RoundTrip(req)
+	}
+	attempt := call.attempt()
+	txn := app.TransactionManager.TransactionFromContext(req.Context())
+	if txn == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	segment := startSegment(txn, "(attempt) "+req.URL.Host+call.urlPattern)
+	defer segment.End()
+	segment.AddAttribute("attempt", attempt)
+
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil:
+		segment.AddAttribute("outcome", attemptOutcomeError)
+	case resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests:
+		segment.AddAttribute("outcome", attemptOutcomeFailure)
+		segment.AddAttribute("http.statusCode", resp.StatusCode)
+	default:
+		segment.AddAttribute("outcome", attemptOutcomeSuccess)
+		segment.AddAttribute("http.statusCode", resp.StatusCode)
+	}
+	return resp, err
+}
+
+// recordRetries adds the retries of the backend call to its segment and the total retries of the request
+// to the transaction as the backend.retries attribute
+func recordRetries(ctx context.Context, txn Transaction, segment interface{}, call *backendCall) {
+	retries := call.attempts() - 1
+	if retries <= 0 {
+		return
+	}
+	if s, ok := segment.(AttributeAdder); ok {
+		s.AddAttribute("retries", retries)
+	}
+	total := retries
+	if counter, ok := ctx.Value(retriesKey).(*retryCounter); ok {
+		total = counter.add(retries)
+	}
+	addAttribute(txn, "backend.retries", total)
+}
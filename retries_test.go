@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyTransport fails with the given outcomes before succeeding
+func flakyTransport(failures ...int) http.RoundTripper {
+	attempt := 0
+	return roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			attempt++
+			status := http.StatusOK
+			if attempt <= len(failures) {
+				status = failures[attempt-1]
+			}
+			if status == 0 {
+				return nil, errors.New("connection refused")
+			}
+			return &http.Response{
+				StatusCode: status,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(strings.NewReader(`{}`)),
+				Request:    req,
+			}, nil
+		},
+	)
+}
+
+// retryingBackend calls the backend with the client until it succeeds, up to 3 attempts
+func retryingBackend(c *http.Client) proxy.Proxy {
+	return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+		var err error
+		for i := 0; i < 3; i++ {
+			req, _ := http.NewRequestWithContext(ctx, request.Method, request.URL.String(), nil)
+			var resp *http.Response
+			resp, err = c.Do(req)
+			if err == nil && resp.StatusCode < http.StatusInternalServerError {
+				return &proxy.Response{IsComplete: true, Metadata: proxy.Metadata{StatusCode: resp.StatusCode}}, nil
+			}
+			if err == nil {
+				err = errors.New(resp.Status)
+			}
+		}
+		return nil, err
+	}
+}
+
+func TestBackendFactory_retries(t *testing.T) {
+	tests := []struct {
+		name               string
+		conf               RetryConfig
+		failures           [][]int
+		wantAttempts       []map[string]interface{}
+		wantSegmentRetries []interface{}
+		wantRetries        interface{}
+	}{
+		{
+			name:               "given the retries are not instrumented, it should not record the attempts",
+			failures:           [][]int{{http.StatusServiceUnavailable}},
+			wantAttempts:       []map[string]interface{}{},
+			wantSegmentRetries: []interface{}{nil},
+		},
+		{
+			name:     "given a call succeeding at once, it should record a single attempt",
+			conf:     RetryConfig{Enabled: true},
+			failures: [][]int{{}},
+			wantAttempts: []map[string]interface{}{
+				{"attempt": int64(1), "outcome": attemptOutcomeSuccess, "http.statusCode": http.StatusOK},
+			},
+			wantSegmentRetries: []interface{}{nil},
+		},
+		{
+			name:     "given a retried call, it should record every attempt and the retries",
+			conf:     RetryConfig{Enabled: true},
+			failures: [][]int{{0, http.StatusServiceUnavailable}},
+			wantAttempts: []map[string]interface{}{
+				{"attempt": int64(1), "outcome": attemptOutcomeError},
+				{"attempt": int64(2), "outcome": attemptOutcomeFailure, "http.statusCode": http.StatusServiceUnavailable},
+				{"attempt": int64(3), "outcome": attemptOutcomeSuccess, "http.statusCode": http.StatusOK},
+			},
+			wantSegmentRetries: []interface{}{int64(2)},
+			wantRetries:        int64(2),
+		},
+		{
+			name:     "given several retried calls, it should sum their retries",
+			conf:     RetryConfig{Enabled: true},
+			failures: [][]int{{http.StatusBadGateway}, {0, 0}},
+			wantAttempts: []map[string]interface{}{
+				{"attempt": int64(1), "outcome": attemptOutcomeFailure, "http.statusCode": http.StatusBadGateway},
+				{"attempt": int64(2), "outcome": attemptOutcomeSuccess, "http.statusCode": http.StatusOK},
+				{"attempt": int64(1), "outcome": attemptOutcomeError},
+				{"attempt": int64(2), "outcome": attemptOutcomeError},
+				{"attempt": int64(3), "outcome": attemptOutcomeSuccess, "http.statusCode": http.StatusOK},
+			},
+			wantSegmentRetries: []interface{}{int64(1), int64(2)},
+			wantRetries:        int64(3),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				recorder := NewRecorder()
+				app = &Application{
+					TransactionManager: recorder,
+					NRApplication:      recorder,
+					Config:             Config{InstrumentationRate: 100, Retries: tt.conf},
+				}
+				defer func() { app = nil }()
+
+				backends := make([]proxy.Proxy, len(tt.failures))
+				for i, failures := range tt.failures {
+					transport := flakyTransport(failures...)
+					clientFactory := RetryHTTPClientFactory(
+						func(ctx context.Context) *http.Client {
+							return &http.Client{Transport: transport}
+						},
+					)
+					bf := BackendFactory(
+						"backend", func(*config.Backend) proxy.Proxy {
+							return retryingBackend(clientFactory(context.Background()))
+						},
+					)
+					backends[i] = bf(&config.Backend{URLPattern: "/users"})
+				}
+				handler := HandlerFactory(
+					func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+						return func(c *gin.Context) {
+							for _, backend := range backends {
+								backendURL, _ := url.Parse("http://backend:8080/users")
+								_, _ = backend(c, &proxy.Request{Method: http.MethodGet, URL: backendURL, Headers: map[string][]string{}})
+							}
+							c.Status(http.StatusOK)
+						}
+					},
+				)(&config.EndpointConfig{Method: http.MethodGet, Endpoint: "/users"}, nil)
+
+				gin.SetMode(gin.TestMode)
+				e := gin.New()
+				e.Use(Middleware())
+				e.GET("/users", handler)
+				e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users", nil))
+
+				txn, ok := recorder.Transaction("/users")
+				if !assert.True(t, ok) {
+					return
+				}
+				attempts := []map[string]interface{}{}
+				segmentRetries := []interface{}{}
+				for _, segment := range txn.Segments {
+					switch segment.Name {
+					case "(attempt) backend:8080/users":
+						assert.True(t, segment.Ended)
+						attempts = append(attempts, segment.Attributes)
+					case "External/backend:8080/http/GET":
+						segmentRetries = append(segmentRetries, segment.Attributes["retries"])
+					}
+				}
+				assert.Equal(t, tt.wantAttempts, attempts)
+				assert.Equal(t, tt.wantSegmentRetries, segmentRetries)
+				assert.Equal(t, tt.wantRetries, txn.Attributes["backend.retries"])
+			},
+		)
+	}
+}
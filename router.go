@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"math/rand"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/luraproject/lura/v2/config"
@@ -11,13 +12,20 @@ import (
 	"github.com/newrelic/go-agent/v3/newrelic"
 )
 
+// ginMiddlewareApplication is implemented by the applications providing their own gin middleware
+type ginMiddlewareApplication interface {
+	GinMiddleware() gin.HandlerFunc
+}
+
 var ginMiddlewareProvider = func(application NRApplication) gin.HandlerFunc {
-	nrApp, ok := application.(*newrelic.Application)
-	if !ok {
-		return emptyMW
+	switch a := application.(type) {
+	case *newrelic.Application:
+		return nrgin.Middleware(a)
+	case ginMiddlewareApplication:
+		return a.GinMiddleware()
 	}
 
-	return nrgin.Middleware(nrApp)
+	return emptyMW
 }
 
 // Middleware adds NewRelic middleware
@@ -26,19 +34,22 @@ func Middleware() gin.HandlerFunc {
 		return emptyMW
 	}
 
-	if app.Config.InstrumentationRate == 0 {
-		return emptyMW
-	}
-
 	nrMiddleware := ginMiddlewareProvider(app.NRApplication)
-
-	if app.Config.InstrumentationRate == 100 {
-		return nrMiddleware
+	sampledMW := clientMW(streamingMW(ratedMW(nrMiddleware, app.SamplingRate)))
+	if app.exclusions.empty() {
+		return sampledMW
 	}
 
-	rate := float64(app.Config.InstrumentationRate) / 100.0
-
-	return ratedMW(nrMiddleware, rate)
+	exclusions := app.exclusions
+	return func(c *gin.Context) {
+		if exclusions.excludes(c.Request) {
+			app.instrumentation.excludedRequest()
+			c.Set(excludedKey, true)
+			emptyMW(c)
+			return
+		}
+		sampledMW(c)
+	}
 }
 
 // HandlerFactory includes NewRelic transaction specific configuration endpoint naming
@@ -48,18 +59,78 @@ func HandlerFactory(handlerFactory router.HandlerFactory) router.HandlerFactory
 	}
 	return func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
 		handler := handlerFactory(cfg, p)
+		classification, err := statusCodeClassificationFor(cfg.ExtraConfig)
+		if err != nil {
+			app.log().Error("invalid status_codes for the endpoint", cfg.Endpoint, err.Error())
+		}
+		slowRequestThreshold, err := slowRequestThresholdFor(cfg.ExtraConfig)
+		if err != nil {
+			app.log().Error("invalid slow_request_threshold for the endpoint", cfg.Endpoint, err.Error())
+		}
+		registerSlowRequestThreshold(cfg, slowRequestThreshold)
+		registerEndpoint(cfg, classification, slowRequestThresholdString(slowRequestThreshold))
+		payloadSizes := app.Config.PayloadSizes.Enabled
+		passthrough := isPassthroughEndpoint(cfg.OutputEncoding)
+		retries := app.Config.Retries.Enabled
 		return func(ctx *gin.Context) {
 			txn := app.TransactionManager.TransactionFromContext(ctx)
-			if txn != nil {
-				txn.SetName(cfg.Endpoint)
+			if txn == nil {
+				handler(ctx)
+				return
+			}
+
+			txn.SetName(cfg.Endpoint)
+			addClientAttributes(txn, ctx)
+			var body *countingReadCloser
+			if payloadSizes {
+				body = countRequestBody(ctx)
+				defer recordPayloadSizes(txn, ctx, cfg, body)
+			}
+			if retries {
+				ctx.Set(retriesKey, &retryCounter{})
+			}
+			if passthrough {
+				streams := &pendingStreams{}
+				ctx.Set(pendingStreamsKey, streams)
+				w := &streamingResponseWriter{ResponseWriter: ctx.Writer}
+				ctx.Writer = w
+				start := time.Now()
+				defer func() {
+					streams.finish()
+					recordStreamedResponse(txn, w, start, time.Now())
+				}()
+			}
+			if slowRequestThreshold <= 0 {
+				handler(ctx)
+				noticeStatusCode(txn, classification, ctx.Writer.Status(), nil)
+				return
 			}
 
+			details := &requestDetails{}
+			ctx.Set(requestDetailsKey, details)
+			start := time.Now()
 			handler(ctx)
+			elapsed := time.Since(start)
+			noticeStatusCode(txn, classification, ctx.Writer.Status(), nil)
+			if ctx.GetBool(streamingConnectionKey) {
+				// the transaction of the streaming connections is ignored, they last as long as the client stays
+				return
+			}
+
+			if elapsed >= slowRequestThreshold {
+				reportSlowRequest(txn, ctx, cfg, details, slowRequestThreshold, elapsed)
+				return
+			}
+			if ctx.GetBool(unsampledTransactionKey) {
+				ignoreTransaction(txn)
+				app.instrumentation.ignoredTransaction()
+			}
 		}
 	}
 }
 
-func ratedMW(middleware gin.HandlerFunc, rate float64) gin.HandlerFunc {
+// ratedMW samples the requests with the current sampling rate, so it can be changed at runtime
+func ratedMW(middleware gin.HandlerFunc, samplingRate func() int) gin.HandlerFunc {
 	next := make(chan float64, 1000)
 	go func(out chan<- float64) {
 		for {
@@ -68,11 +139,18 @@ func ratedMW(middleware gin.HandlerFunc, rate float64) gin.HandlerFunc {
 	}(next)
 
 	return func(c *gin.Context) {
-		if n := <-next; n <= rate {
+		rate := samplingRate()
+		if rate >= 100 {
 			middleware(c)
 			return
 		}
-		emptyMW(c)
+		if rate > 0 {
+			if n := <-next; n <= float64(rate)/100.0 {
+				middleware(c)
+				return
+			}
+		}
+		unsampledMW(middleware, c)
 	}
 }
 
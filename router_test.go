@@ -11,6 +11,7 @@ import (
 	"github.com/luraproject/lura/v2/config"
 	"github.com/luraproject/lura/v2/proxy"
 	router "github.com/luraproject/lura/v2/router/gin"
+	"github.com/newrelic/go-agent/v3/newrelic"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -21,6 +22,9 @@ func TestMiddleware(t *testing.T) {
 		req *http.Request
 	}
 	callCount := 0
+	defer func(provider func(NRApplication) gin.HandlerFunc) {
+		ginMiddlewareProvider = provider
+	}(ginMiddlewareProvider)
 	ginMiddlewareProvider = func(application NRApplication) gin.HandlerFunc {
 		return func(context *gin.Context) {
 			callCount++
@@ -222,6 +226,82 @@ func TestHandlerFactory(t *testing.T) {
 				Config:        Config{},
 			},
 		},
+		{
+			name: "given an expected status code for the endpoint, it should only add the error.expected attribute",
+			args: args{
+				cfg: &config.EndpointConfig{
+					Method:   "GET",
+					Endpoint: "some-endpoint",
+					ExtraConfig: config.ExtraConfig{
+						Namespace: map[string]interface{}{
+							"status_codes": map[string]interface{}{"expected_status_codes": []int{404}},
+						},
+					},
+				},
+				handlerFactory: func(config *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+					return func(c *gin.Context) {
+						c.Status(http.StatusNotFound)
+					}
+				},
+			},
+			app: &Application{
+				TransactionManager: func() TransactionManager {
+					tm := NewMockTransactionManager(ctrl)
+					tx := newMockTransaction(ctrl)
+					tm.EXPECT().TransactionFromContext(gomock.AssignableToTypeOf(&gin.Context{})).
+						Times(1).
+						Return(tx)
+					tx.EXPECT().SetName("some-endpoint").
+						Times(1)
+					tx.attributes.EXPECT().AddAttribute("error.expected", true).
+						Times(1)
+					tx.errors.EXPECT().NoticeError(gomock.Any()).
+						Times(0)
+
+					return tm
+				}(),
+				NRApplication: NewMockNRApplication(ctrl),
+				Config:        Config{StatusCodes: &StatusCodeClassification{}},
+			},
+		},
+		{
+			name: "given an error status code for the endpoint, it should notice the error",
+			args: args{
+				cfg: &config.EndpointConfig{
+					Method:   "GET",
+					Endpoint: "some-endpoint",
+				},
+				handlerFactory: func(config *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+					return func(c *gin.Context) {
+						c.Status(http.StatusTooManyRequests)
+					}
+				},
+			},
+			app: &Application{
+				TransactionManager: func() TransactionManager {
+					tm := NewMockTransactionManager(ctrl)
+					tx := newMockTransaction(ctrl)
+					tm.EXPECT().TransactionFromContext(gomock.AssignableToTypeOf(&gin.Context{})).
+						Times(1).
+						Return(tx)
+					tx.EXPECT().SetName("some-endpoint").
+						Times(1)
+					tx.errors.EXPECT().NoticeError(
+						newrelic.Error{
+							Message:    "429 Too Many Requests",
+							Class:      "429",
+							Attributes: map[string]interface{}{"http.statusCode": 429},
+						},
+					).Times(1)
+
+					return tm
+				}(),
+				NRApplication: NewMockNRApplication(ctrl),
+				Config: Config{
+					StatusCodes: &StatusCodeClassification{ErrorStatusCodes: []int{429}},
+				},
+			},
+		},
 		{
 			name: "given app is nil, it should not set transaction name",
 			args: args{
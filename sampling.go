@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/logging"
+)
+
+const defaultSamplingWatchInterval = 10 * time.Second
+
+// SamplingConfig configures how the sampling rate can be changed at runtime
+type SamplingConfig struct {
+	Endpoint      string `json:"endpoint"`
+	File          string `json:"file"`
+	WatchInterval string `json:"watch_interval"`
+}
+
+type samplingRateRequest struct {
+	Rate *int `json:"rate"`
+}
+
+// SamplingRate returns the current sampling rate, the configured rate until it is changed
+func (a *Application) SamplingRate() int {
+	if rate, ok := a.samplingRate.Load().(int); ok {
+		return rate
+	}
+	return a.Config.InstrumentationRate
+}
+
+// SetSamplingRate changes the sampling rate used by the middleware, between 0 and 100
+func (a *Application) SetSamplingRate(rate int) error {
+	if rate < 0 || rate > 100 {
+		return fmt.Errorf("invalid sampling rate %d, it must be between 0 and 100", rate)
+	}
+	a.samplingRate.Store(rate)
+
+	return nil
+}
+
+// WatchSamplingRate sets the sampling rate from the sampling file when it changes, and when the process receives
+// a SIGHUP, until the context is done
+func (a *Application) WatchSamplingRate(ctx context.Context, logger logging.Logger) {
+	if a.Config.Sampling.File == "" {
+		return
+	}
+	interval := a.samplingWatchInterval
+	if interval == 0 {
+		interval = defaultSamplingWatchInterval
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer signal.Stop(hup)
+		defer ticker.Stop()
+
+		var modTime time.Time
+		var lastErr string
+		for {
+			info, err := os.Stat(a.Config.Sampling.File)
+			if err != nil {
+				if err.Error() != lastErr {
+					logger.Error("unable to watch the sampling rate file", err.Error())
+				}
+				lastErr = err.Error()
+			} else if !info.ModTime().Equal(modTime) {
+				lastErr = ""
+				modTime = info.ModTime()
+				a.loadSamplingRate(logger)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				a.loadSamplingRate(logger)
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (a *Application) loadSamplingRate(logger logging.Logger) {
+	b, err := ioutil.ReadFile(a.Config.Sampling.File)
+	if err != nil {
+		logger.Error("unable to read the sampling rate file", err.Error())
+		return
+	}
+	rate, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err == nil {
+		err = a.SetSamplingRate(rate)
+	}
+	if err != nil {
+		logger.Error("unable to set the sampling rate from the file", err.Error())
+		return
+	}
+	logger.Info("sampling rate set to", rate)
+}
+
+// SamplingRateHandler responds with the sampling rate of the registered application on GET,
+// and changes it on PUT with a {"rate": 100} body
+func SamplingRateHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if app == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "the NR module is not registered"})
+			return
+		}
+
+		if c.Request.Method == http.MethodPut {
+			req := samplingRateRequest{}
+			if err := c.ShouldBindJSON(&req); err != nil || req.Rate == nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "the rate is required"})
+				return
+			}
+			if err := app.SetSamplingRate(*req.Rate); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, SamplingStatus{Rate: app.SamplingRate(), Configured: app.Config.InstrumentationRate})
+	}
+}
+
+// RegisterSamplingRateEndpoint adds the sampling rate endpoint to the engine when the sampling endpoint and the
+// admin_token are configured. The engine should not be reachable from the public network.
+func RegisterSamplingRateEndpoint(engine gin.IRoutes) {
+	if app == nil || app.Config.Sampling.Endpoint == "" {
+		return
+	}
+	if handlers, ok := adminHandlers(app.Config.Sampling.Endpoint, SamplingRateHandler()); ok {
+		engine.GET(app.Config.Sampling.Endpoint, handlers...)
+		engine.PUT(app.Config.Sampling.Endpoint, handlers...)
+	}
+}
@@ -0,0 +1,218 @@
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplication_SetSamplingRate(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     int
+		wantRate int
+		wantErr  assert.ErrorAssertionFunc
+	}{
+		{
+			name:     "given a rate between 0 and 100, it should change the sampling rate",
+			rate:     25,
+			wantRate: 25,
+			wantErr:  assert.NoError,
+		},
+		{
+			name:     "given a negative rate, it should keep the configured rate",
+			rate:     -1,
+			wantRate: 50,
+			wantErr:  assert.Error,
+		},
+		{
+			name:     "given a rate above 100, it should keep the configured rate",
+			rate:     101,
+			wantRate: 50,
+			wantErr:  assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				a := &Application{Config: Config{InstrumentationRate: 50}}
+
+				tt.wantErr(t, a.SetSamplingRate(tt.rate))
+				assert.Equal(t, tt.wantRate, a.SamplingRate())
+			},
+		)
+	}
+}
+
+func TestMiddleware_samplingRate(t *testing.T) {
+	callCount := 0
+	defer func(provider func(NRApplication) gin.HandlerFunc) {
+		ginMiddlewareProvider = provider
+	}(ginMiddlewareProvider)
+	ginMiddlewareProvider = func(application NRApplication) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			callCount++
+		}
+	}
+	app = &Application{Config: Config{InstrumentationRate: 0}}
+	defer func() { app = nil }()
+
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.Use(Middleware())
+
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users", nil))
+	assert.Equal(t, 0, callCount)
+
+	assert.NoError(t, app.SetSamplingRate(100))
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users", nil))
+	assert.Equal(t, 1, callCount)
+
+	assert.NoError(t, app.SetSamplingRate(0))
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users", nil))
+	assert.Equal(t, 1, callCount)
+}
+
+func TestRegisterSamplingRateEndpoint(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		authorization string
+		body          string
+		wantStatus    int
+		wantRate      int
+	}{
+		{
+			name:          "given a GET request, it should respond with the sampling rate",
+			method:        http.MethodGet,
+			authorization: "Bearer s3cr3t",
+			wantStatus:    http.StatusOK,
+			wantRate:      10,
+		},
+		{
+			name:          "given a PUT request with a rate, it should change the sampling rate",
+			method:        http.MethodPut,
+			authorization: "Bearer s3cr3t",
+			body:          `{"rate": 100}`,
+			wantStatus:    http.StatusOK,
+			wantRate:      100,
+		},
+		{
+			name:          "given a PUT request with an invalid rate, it should respond with a bad request",
+			method:        http.MethodPut,
+			authorization: "Bearer s3cr3t",
+			body:          `{"rate": 200}`,
+			wantStatus:    http.StatusBadRequest,
+			wantRate:      10,
+		},
+		{
+			name:          "given a PUT request without a rate, it should respond with a bad request",
+			method:        http.MethodPut,
+			authorization: "Bearer s3cr3t",
+			body:          `{}`,
+			wantStatus:    http.StatusBadRequest,
+			wantRate:      10,
+		},
+		{
+			name:       "given a PUT request without the admin token, it should respond with an unauthorized",
+			method:     http.MethodPut,
+			body:       `{"rate": 100}`,
+			wantStatus: http.StatusUnauthorized,
+			wantRate:   10,
+		},
+		{
+			name:          "given a PUT request with another token, it should respond with an unauthorized",
+			method:        http.MethodPut,
+			authorization: "Bearer other",
+			body:          `{"rate": 100}`,
+			wantStatus:    http.StatusUnauthorized,
+			wantRate:      10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				app = &Application{
+					Config: Config{
+						InstrumentationRate: 10,
+						Sampling:            SamplingConfig{Endpoint: "/__sampling"},
+						AdminToken:          "s3cr3t",
+					},
+				}
+				defer func() { app = nil }()
+
+				gin.SetMode(gin.TestMode)
+				e := gin.New()
+				RegisterSamplingRateEndpoint(e)
+
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(tt.method, "/__sampling", strings.NewReader(tt.body))
+				req.Header.Set("Authorization", tt.authorization)
+				e.ServeHTTP(w, req)
+
+				assert.Equal(t, tt.wantStatus, w.Code)
+				assert.Equal(t, tt.wantRate, app.SamplingRate())
+			},
+		)
+	}
+}
+
+func TestRegisterSamplingRateEndpoint_withoutAdminToken(t *testing.T) {
+	app = &Application{Config: Config{Sampling: SamplingConfig{Endpoint: "/__sampling"}}}
+	defer func() { app = nil }()
+
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	RegisterSamplingRateEndpoint(e)
+
+	assert.Empty(t, e.Routes())
+}
+
+func TestApplication_WatchSamplingRate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sampling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "rate")
+	if err := ioutil.WriteFile(file, []byte("25\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Application{
+		Config:                Config{InstrumentationRate: 10, Sampling: SamplingConfig{File: file}},
+		samplingWatchInterval: time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.WatchSamplingRate(ctx, logging.NoOp)
+
+	assert.Eventually(
+		t, func() bool {
+			return a.SamplingRate() == 25
+		}, time.Second, time.Millisecond,
+	)
+
+	if err := ioutil.WriteFile(file, []byte("75"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, future, future); err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(
+		t, func() bool {
+			return a.SamplingRate() == 75
+		}, time.Second, time.Millisecond,
+	)
+}
@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/transport/http/client"
+)
+
+const (
+	requestSizeMetric         = "Custom/KrakenD/RequestSize/"
+	responseSizeMetric        = "Custom/KrakenD/ResponseSize/"
+	backendResponseSizeMetric = "Custom/KrakenD/BackendResponseSize/"
+)
+
+// PayloadSizeConfig configures the payload size attributes and metrics
+type PayloadSizeConfig struct {
+	Enabled bool `json:"enabled"`
+	Metrics bool `json:"metrics"`
+}
+
+// countingReadCloser counts the bytes read from the body
+type countingReadCloser struct {
+	n int64
+	io.ReadCloser
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
+
+func (r *countingReadCloser) count() int64 {
+	return atomic.LoadInt64(&r.n)
+}
+
+// countRequestBody replaces the body of the request with one counting the bytes read by the gateway
+func countRequestBody(c *gin.Context) *countingReadCloser {
+	if c.Request.Body == nil || c.Request.Body == http.NoBody {
+		return nil
+	}
+	body := &countingReadCloser{ReadCloser: c.Request.Body}
+	c.Request.Body = body
+	return body
+}
+
+// recordPayloadSizes adds the sizes of the request body and of the response sent to the client to the transaction.
+// The request body size is the Content-Length, or the bytes read when it is not known.
+func recordPayloadSizes(txn Transaction, c *gin.Context, cfg *config.EndpointConfig, body *countingReadCloser) {
+	requestSize := c.Request.ContentLength
+	if body != nil && body.count() > requestSize {
+		requestSize = body.count()
+	}
+	if requestSize < 0 {
+		requestSize = 0
+	}
+	responseSize := int64(c.Writer.Size())
+	if responseSize < 0 {
+		responseSize = 0
+	}
+
+	addAttribute(txn, "request.bodySize", requestSize)
+	addAttribute(txn, "response.bodySize", responseSize)
+
+	if !app.Config.PayloadSizes.Metrics {
+		return
+	}
+	name := strings.ToUpper(cfg.Method) + cfg.Endpoint
+	app.RecordCustomMetric(requestSizeMetric+name, float64(requestSize))
+	app.RecordCustomMetric(responseSizeMetric+name, float64(responseSize))
+}
+
+// SizeHTTPClientFactory wraps the http client factory of the backends, so the size of the backend responses
+// without a Content-Length is the number of bytes read from their body.
+func SizeHTTPClientFactory(next client.HTTPClientFactory) client.HTTPClientFactory {
+	return func(ctx context.Context) *http.Client {
+		c := *next(ctx)
+		transport := c.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		c.Transport = sizeRoundTripper{next: transport}
+		return &c
+	}
+}
+
+type sizeRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (t sizeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.Body != nil {
+		if call := backendCallFromContext(req.Context()); call != nil {
+			call.countResponseBody(resp)
+		}
+	}
+	return resp, err
+}
+
+// recordBackendResponseSize adds the size of the backend response to its segment.
+// The size is the Content-Length of the response, or the bytes read from its body when it was counted by the
+// http client. The size of the streamed responses is recorded once they are copied to the client.
+func recordBackendResponseSize(segment interface{}, call *backendCall, resp *proxy.Response, host, urlPattern string) {
+	size, ok := backendResponseSize(resp, call)
+	if !ok {
+		return
+	}
+
+	if s, ok := segment.(AttributeAdder); ok {
+		s.AddAttribute("response.bodySize", size)
+	}
+	if app.Config.PayloadSizes.Metrics {
+		app.RecordCustomMetric(backendResponseSizeMetric+host+urlPattern, float64(size))
+	}
+}
+
+func backendResponseSize(resp *proxy.Response, call *backendCall) (int64, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	if v := http.Header(resp.Metadata.Headers).Get("Content-Length"); v != "" {
+		if size, err := strconv.ParseInt(v, 10, 64); err == nil && size >= 0 {
+			return size, true
+		}
+	}
+	if resp.Io != nil || call == nil {
+		return 0, false
+	}
+	return call.responseBodySize()
+}
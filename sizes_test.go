@@ -0,0 +1,229 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerFactory_payloadSizes(t *testing.T) {
+	tests := []struct {
+		name             string
+		conf             PayloadSizeConfig
+		body             string
+		chunked          bool
+		wantAttributes   map[string]interface{}
+		wantSegmentAttrs map[string]interface{}
+		wantMetrics      map[string][]float64
+	}{
+		{
+			name:             "given payload sizes are disabled, it should not record them",
+			conf:             PayloadSizeConfig{},
+			body:             `{"name":"gopher"}`,
+			wantAttributes:   map[string]interface{}{},
+			wantSegmentAttrs: map[string]interface{}{},
+			wantMetrics:      map[string][]float64{"Custom/KrakenD/RequestSize/POST/users": {}},
+		},
+		{
+			name: "given payload sizes are enabled, it should record them as attributes",
+			conf: PayloadSizeConfig{Enabled: true},
+			body: `{"name":"gopher"}`,
+			wantAttributes: map[string]interface{}{
+				"request.bodySize":  int64(17),
+				"response.bodySize": int64(13),
+			},
+			wantSegmentAttrs: map[string]interface{}{"response.bodySize": int64(15)},
+			wantMetrics:      map[string][]float64{"Custom/KrakenD/RequestSize/POST/users": {}},
+		},
+		{
+			name:    "given a chunked request body, it should record the bytes read",
+			conf:    PayloadSizeConfig{Enabled: true},
+			body:    `{"name":"gopher"}`,
+			chunked: true,
+			wantAttributes: map[string]interface{}{
+				"request.bodySize":  int64(17),
+				"response.bodySize": int64(13),
+			},
+			wantSegmentAttrs: map[string]interface{}{"response.bodySize": int64(15)},
+		},
+		{
+			name: "given payload size metrics are enabled, it should record the custom metrics",
+			conf: PayloadSizeConfig{Enabled: true, Metrics: true},
+			body: `{"name":"gopher"}`,
+			wantAttributes: map[string]interface{}{
+				"request.bodySize":  int64(17),
+				"response.bodySize": int64(13),
+			},
+			wantSegmentAttrs: map[string]interface{}{"response.bodySize": int64(15)},
+			wantMetrics: map[string][]float64{
+				"Custom/KrakenD/RequestSize/POST/users":                     {17},
+				"Custom/KrakenD/ResponseSize/POST/users":                    {13},
+				"Custom/KrakenD/BackendResponseSize/backend:8080/users/add": {15},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				recorder := NewRecorder()
+				app = &Application{
+					TransactionManager: recorder,
+					NRApplication:      recorder,
+					Config:             Config{InstrumentationRate: 100, PayloadSizes: tt.conf},
+				}
+				defer func() { app = nil }()
+
+				backendURL, _ := url.Parse("http://backend:8080/users/add")
+				clientFactory := SizeHTTPClientFactory(
+					func(context.Context) *http.Client {
+						return &http.Client{
+							Transport: roundTripperFunc(
+								func(req *http.Request) (*http.Response, error) {
+									return &http.Response{
+										StatusCode: http.StatusOK,
+										Header:     http.Header{},
+										Body:       ioutil.NopCloser(strings.NewReader(`{"id":"gopher"}`)),
+										Request:    req,
+									}, nil
+								},
+							),
+						}
+					},
+				)
+				bf := BackendFactory(
+					"backend", func(*config.Backend) proxy.Proxy {
+						return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+							req, _ := http.NewRequestWithContext(ctx, request.Method, request.URL.String(), nil)
+							resp, err := clientFactory(ctx).Do(req)
+							if err != nil {
+								return nil, err
+							}
+							defer resp.Body.Close()
+							body, _ := ioutil.ReadAll(resp.Body)
+							data := map[string]interface{}{}
+							if err := json.Unmarshal(body, &data); err != nil {
+								return nil, err
+							}
+							return &proxy.Response{Data: data, Metadata: proxy.Metadata{StatusCode: resp.StatusCode}}, nil
+						}
+					},
+				)
+				p := bf(&config.Backend{URLPattern: "/users/add"})
+				handler := HandlerFactory(
+					func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+						return func(c *gin.Context) {
+							body, _ := ioutil.ReadAll(c.Request.Body)
+							_, _ = p(
+								c, &proxy.Request{
+									Method: http.MethodPost, URL: backendURL, Headers: map[string][]string{},
+									Body: ioutil.NopCloser(strings.NewReader(string(body))),
+								},
+							)
+							c.String(http.StatusOK, `{"id":"user"}`)
+						}
+					},
+				)(&config.EndpointConfig{Method: http.MethodPost, Endpoint: "/users"}, p)
+
+				gin.SetMode(gin.TestMode)
+				e := gin.New()
+				e.Use(Middleware())
+				e.POST("/users", handler)
+				req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(tt.body))
+				if tt.chunked {
+					req.ContentLength = -1
+				}
+				e.ServeHTTP(httptest.NewRecorder(), req)
+
+				txn, ok := recorder.Transaction("/users")
+				if !assert.True(t, ok) {
+					return
+				}
+				for k, v := range tt.wantAttributes {
+					assert.Equal(t, v, txn.Attributes[k], k)
+				}
+				if len(tt.wantAttributes) == 0 {
+					assert.NotContains(t, txn.Attributes, "request.bodySize")
+					assert.NotContains(t, txn.Attributes, "response.bodySize")
+				}
+				segment, ok := txn.Segment("External/backend:8080/http/POST")
+				if assert.True(t, ok) {
+					assert.Equal(t, tt.wantSegmentAttrs, segment.Attributes)
+				}
+				for name, values := range tt.wantMetrics {
+					assert.Equal(t, values, recorder.Metrics(name), name)
+				}
+			},
+		)
+	}
+}
+
+func Test_backendResponseSize(t *testing.T) {
+	countedCall := func(body string) *backendCall {
+		call := &backendCall{}
+		resp := &http.Response{Body: ioutil.NopCloser(strings.NewReader(body))}
+		call.countResponseBody(resp)
+		_, _ = ioutil.ReadAll(resp.Body)
+		return call
+	}
+	tests := []struct {
+		name     string
+		resp     *proxy.Response
+		call     *backendCall
+		wantSize int64
+		wantOk   bool
+	}{
+		{
+			name: "given no response, it should not measure it",
+		},
+		{
+			name: "given a Content-Length, it should return it",
+			resp: &proxy.Response{
+				Data:     map[string]interface{}{"id": "gopher"},
+				Metadata: proxy.Metadata{Headers: map[string][]string{"Content-Length": {"42"}}},
+			},
+			call:     countedCall(`{"id":"gopher"}`),
+			wantSize: 42,
+			wantOk:   true,
+		},
+		{
+			name:     "given a counted body, it should return the bytes read",
+			resp:     &proxy.Response{Data: map[string]interface{}{"id": "gopher"}},
+			call:     countedCall(`{"id": "gopher"}`),
+			wantSize: 16,
+			wantOk:   true,
+		},
+		{
+			name: "given decoded data without a counted body, it should not measure it",
+			resp: &proxy.Response{Data: map[string]interface{}{"id": "gopher"}},
+			call: &backendCall{},
+		},
+		{
+			name: "given a streamed response, it should not measure it",
+			resp: &proxy.Response{Data: map[string]interface{}{}, Io: strings.NewReader("body")},
+			call: countedCall("body"),
+		},
+		{
+			name: "given no call, it should not measure it",
+			resp: &proxy.Response{Data: map[string]interface{}{"id": "gopher"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				size, ok := backendResponseSize(tt.resp, tt.call)
+				assert.Equal(t, tt.wantOk, ok)
+				assert.Equal(t, tt.wantSize, size)
+			},
+		)
+	}
+}
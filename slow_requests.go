@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+)
+
+// SlowRequestEventType is the custom event recorded for the requests slower than their threshold
+const SlowRequestEventType = "KrakendSlowRequest"
+
+const (
+	unsampledTransactionKey = "krakendNewRelicUnsampledTransaction"
+	requestDetailsKey       = "krakendNewRelicRequestDetails"
+)
+
+type slowRequestConfig struct {
+	SlowRequestThreshold string `json:"slow_request_threshold"`
+}
+
+type backendTiming struct {
+	url        *url.URL
+	duration   time.Duration
+	statusCode int
+}
+
+// requestDetails collects the backend calls of a request so they can be reported when it is slow
+type requestDetails struct {
+	mu       sync.Mutex
+	backends []backendTiming
+}
+
+func (d *requestDetails) addBackend(u *url.URL, duration time.Duration, statusCode int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.backends = append(d.backends, backendTiming{url: u, duration: duration, statusCode: statusCode})
+}
+
+func (d *requestDetails) backendTimings() []backendTiming {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result := make([]backendTiming, len(d.backends))
+	copy(result, d.backends)
+	return result
+}
+
+// requestDetailsFromContext returns the details of the request when its slowness is being tracked.
+// The lura context is derived from the gin context, so the value set in the gin keys can be found from the backends.
+func requestDetailsFromContext(ctx context.Context) *requestDetails {
+	d, _ := ctx.Value(requestDetailsKey).(*requestDetails)
+	return d
+}
+
+// slowRequestThresholdFor returns the threshold defined in the endpoint extra_config,
+// falling back to the one defined in the service, also returned with the error when it is invalid.
+func slowRequestThresholdFor(cfg config.ExtraConfig) (time.Duration, error) {
+	result := slowRequestConfig{}
+	if err := decodeExtraConfig(cfg, &result); err != nil || result.SlowRequestThreshold == "" {
+		return app.slowRequestThreshold, nil
+	}
+	threshold, err := time.ParseDuration(result.SlowRequestThreshold)
+	if err != nil {
+		return app.slowRequestThreshold, err
+	}
+	return threshold, nil
+}
+
+func routeKey(method, path string) string {
+	return strings.ToUpper(method) + " " + path
+}
+
+func registerSlowRequestThreshold(cfg *config.EndpointConfig, threshold time.Duration) {
+	if threshold <= 0 {
+		return
+	}
+	app.slowRequestThresholds.Store(routeKey(cfg.Method, cfg.Endpoint), threshold)
+}
+
+func slowRequestThresholdString(threshold time.Duration) string {
+	if threshold <= 0 {
+		return ""
+	}
+	return threshold.String()
+}
+
+// tracksSlowRequests tells whether the route of the request has a slow request threshold
+func tracksSlowRequests(c *gin.Context) bool {
+	_, ok := app.slowRequestThresholds.Load(routeKey(c.Request.Method, c.FullPath()))
+	return ok
+}
+
+// unsampledMW starts the transaction of the requests not selected by the sampler when their slowness is tracked.
+// These provisional transactions are only kept when the request is slow.
+func unsampledMW(middleware gin.HandlerFunc, c *gin.Context) {
+	app.instrumentation.unsampledRequest()
+	c.Set(sampledOutKey, true)
+	if !tracksSlowRequests(c) {
+		emptyMW(c)
+		return
+	}
+
+	c.Set(unsampledTransactionKey, true)
+	middleware(c)
+}
+
+// provisionalTransaction tells whether the transaction of the request is only kept when the request is slow.
+// Its trace headers are not sent to the backends, as its spans are most likely never sent.
+func provisionalTransaction(ctx context.Context) bool {
+	provisional, _ := ctx.Value(unsampledTransactionKey).(bool)
+	return provisional
+}
+
+func reportSlowRequest(
+	txn Transaction,
+	c *gin.Context,
+	cfg *config.EndpointConfig,
+	details *requestDetails,
+	threshold, elapsed time.Duration,
+) {
+	params := map[string]interface{}{
+		"endpoint":    cfg.Endpoint,
+		"method":      c.Request.Method,
+		"durationMs":  elapsed.Milliseconds(),
+		"thresholdMs": threshold.Milliseconds(),
+		"requestSize": c.Request.ContentLength,
+		"statusCode":  c.Writer.Status(),
+	}
+
+	hosts := make([]string, 0)
+	for i, b := range details.backendTimings() {
+		prefix := "backend." + strconv.Itoa(i)
+		params[prefix+".url"] = b.url.String()
+		params[prefix+".durationMs"] = b.duration.Milliseconds()
+		params[prefix+".statusCode"] = b.statusCode
+		hosts = append(hosts, b.url.Host)
+	}
+	params["hosts"] = strings.Join(hosts, ",")
+
+	addAttribute(txn, "slowRequest", true)
+	for k, v := range params {
+		addAttribute(txn, "slowRequest."+k, v)
+	}
+	if id := c.GetString(clientIDKey); id != "" {
+		params["client.id"] = id
+	}
+	app.RecordCustomEvent(SlowRequestEventType, params)
+}
@@ -0,0 +1,263 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerFactory_slowRequests(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	type args struct {
+		threshold string
+		unsampled bool
+	}
+	tests := []struct {
+		name string
+		args args
+		app  func(tx *mockTransaction) *Application
+	}{
+		{
+			name: "given the request is slower than the threshold, it should record the details and the custom event",
+			args: args{threshold: "1ns", unsampled: true},
+			app: func(tx *mockTransaction) *Application {
+				tx.EXPECT().SetName("/slow")
+				tx.attributes.EXPECT().AddAttribute("slowRequest", true)
+				tx.attributes.EXPECT().AddAttribute("slowRequest.hosts", "backend:8080")
+				tx.attributes.EXPECT().AddAttribute("slowRequest.backend.0.url", "http://backend:8080/foo")
+				tx.attributes.EXPECT().AddAttribute("slowRequest.backend.0.statusCode", http.StatusOK)
+				tx.attributes.EXPECT().AddAttribute(gomock.Any(), gomock.Any()).AnyTimes()
+				tx.ignorer.EXPECT().Ignore().Times(0)
+
+				nrApp := NewMockNRApplication(ctrl)
+				nrApp.EXPECT().RecordCustomEvent(SlowRequestEventType, gomock.Any()).Do(
+					func(eventType string, params map[string]interface{}) {
+						assert.Equal(t, "/slow", params["endpoint"])
+						assert.Equal(t, "backend:8080", params["hosts"])
+					},
+				)
+
+				return &Application{NRApplication: nrApp}
+			},
+		},
+		{
+			name: "given an unsampled request faster than the threshold, it should ignore the transaction",
+			args: args{threshold: "1h", unsampled: true},
+			app: func(tx *mockTransaction) *Application {
+				tx.EXPECT().SetName("/slow")
+				tx.ignorer.EXPECT().Ignore()
+
+				return &Application{NRApplication: NewMockNRApplication(ctrl)}
+			},
+		},
+		{
+			name: "given a sampled request faster than the threshold, it should keep the transaction",
+			args: args{threshold: "1h", unsampled: false},
+			app: func(tx *mockTransaction) *Application {
+				tx.EXPECT().SetName("/slow")
+				tx.ignorer.EXPECT().Ignore().Times(0)
+
+				return &Application{NRApplication: NewMockNRApplication(ctrl)}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				tx := newMockTransaction(ctrl)
+				tm := NewMockTransactionManager(ctrl)
+				tm.EXPECT().TransactionFromContext(gomock.Any()).Return(tx).AnyTimes()
+				tm.EXPECT().StartExternalSegment(tx, gomock.Any()).DoAndReturn(
+					func(txn Transaction, req *http.Request) TransactionEndStatusCodeSetter {
+						req.Header.Set("Traceparent", "00-trace-span-01")
+						seg := NewMockTransactionEndStatusCodeSetter(ctrl)
+						seg.EXPECT().SetStatusCode(http.StatusOK)
+						seg.EXPECT().End()
+						return seg
+					},
+				).AnyTimes()
+				app = tt.app(tx)
+				app.TransactionManager = tm
+
+				backendURL, err := url.Parse("http://backend:8080/foo")
+				if err != nil {
+					t.Fatal(err)
+				}
+				backend := NewBackend(
+					"backend", func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+						_, traced := request.Headers["Traceparent"]
+						assert.Equal(t, !tt.args.unsampled, traced)
+						return &proxy.Response{Metadata: proxy.Metadata{StatusCode: http.StatusOK}}, nil
+					},
+				)
+
+				cfg := &config.EndpointConfig{
+					Method:   http.MethodGet,
+					Endpoint: "/slow",
+					ExtraConfig: config.ExtraConfig{
+						Namespace: map[string]interface{}{"slow_request_threshold": tt.args.threshold},
+					},
+				}
+				handler := HandlerFactory(
+					func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+						return func(c *gin.Context) {
+							_, _ = p(c, &proxy.Request{Method: http.MethodGet, URL: backendURL})
+							c.Status(http.StatusOK)
+						}
+					},
+				)(cfg, backend)
+
+				c, _ := gin.CreateTestContext(httptest.NewRecorder())
+				c.Request = httptest.NewRequest(http.MethodGet, "/slow", nil)
+				if tt.args.unsampled {
+					c.Set(unsampledTransactionKey, true)
+				}
+				handler(c)
+			},
+		)
+	}
+}
+
+func TestMiddleware_slowRequests(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	callCount := 0
+	defer func(provider func(NRApplication) gin.HandlerFunc) {
+		ginMiddlewareProvider = provider
+	}(ginMiddlewareProvider)
+	ginMiddlewareProvider = func(application NRApplication) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			callCount++
+		}
+	}
+	tests := []struct {
+		name      string
+		path      string
+		threshold string
+		want      int
+	}{
+		{
+			name:      "given an endpoint tracking slow requests, it should start the transaction of unsampled requests",
+			path:      "/slow",
+			threshold: "500ms",
+			want:      1,
+		},
+		{
+			name: "given an endpoint not tracking slow requests, it should not start the transaction of unsampled requests",
+			path: "/fast",
+			want: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				app = &Application{
+					TransactionManager: NewMockTransactionManager(ctrl),
+					NRApplication:      NewMockNRApplication(ctrl),
+					Config:             Config{InstrumentationRate: 0},
+				}
+				callCount = 0
+
+				gin.SetMode(gin.TestMode)
+				w := httptest.NewRecorder()
+				_, e := gin.CreateTestContext(w)
+				e.Use(Middleware())
+
+				cfg := &config.EndpointConfig{
+					Method:   http.MethodGet,
+					Endpoint: tt.path,
+					ExtraConfig: config.ExtraConfig{
+						Namespace: map[string]interface{}{"slow_request_threshold": tt.threshold},
+					},
+				}
+				threshold, err := slowRequestThresholdFor(cfg.ExtraConfig)
+				assert.NoError(t, err)
+				registerSlowRequestThreshold(cfg, threshold)
+				e.GET(tt.path, func(c *gin.Context) {})
+
+				e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+				assert.Equal(t, tt.want, callCount)
+			},
+		)
+	}
+}
+
+func Test_slowRequestThresholdFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.ExtraConfig
+		want    time.Duration
+		wantErr bool
+	}{
+		{
+			name: "given a threshold in the extra config, it should use it",
+			cfg:  config.ExtraConfig{Namespace: map[string]interface{}{"slow_request_threshold": "2s"}},
+			want: 2 * time.Second,
+		},
+		{
+			name: "given no threshold in the extra config, it should use the service threshold",
+			cfg:  config.ExtraConfig{},
+			want: time.Second,
+		},
+		{
+			name:    "given an invalid threshold in the extra config, it should return an error",
+			cfg:     config.ExtraConfig{Namespace: map[string]interface{}{"slow_request_threshold": "2 seconds"}},
+			want:    time.Second,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				app = &Application{slowRequestThreshold: time.Second}
+				defer func() { app = nil }()
+
+				got, err := slowRequestThresholdFor(tt.cfg)
+				assert.Equal(t, tt.want, got)
+				assert.Equal(t, tt.wantErr, err != nil)
+			},
+		)
+	}
+}
+
+func TestHandlerFactory_invalidSlowRequestThreshold(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := logging.NewLogger("ERROR", buf, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app = &Application{logger: logger}
+	defer func() { app = nil }()
+
+	HandlerFactory(
+		func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+			return func(c *gin.Context) {}
+		},
+	)(
+		&config.EndpointConfig{
+			Method:   http.MethodGet,
+			Endpoint: "/invalid",
+			ExtraConfig: config.ExtraConfig{
+				Namespace: map[string]interface{}{"slow_request_threshold": "2 seconds"},
+			},
+		},
+		func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			return nil, errors.New("not called")
+		},
+	)
+
+	assert.Contains(t, buf.String(), "invalid slow_request_threshold for the endpoint /invalid")
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/luraproject/lura/v2/proxy"
+)
+
+const (
+	// sampledOutKey flags the requests the router middleware did not sample
+	sampledOutKey = "krakendNewRelicSampledOut"
+	// excludedKey flags the requests excluded from the instrumentation
+	excludedKey = "krakendNewRelicExcluded"
+)
+
+// StandaloneTransactionConfig configures the transactions started by the backends and the proxies
+// called without a transaction, e.g. by internal callers
+type StandaloneTransactionConfig struct {
+	Enabled bool `json:"enabled"`
+	// Unsampled also starts them for the requests not sampled by the router middleware
+	Unsampled bool `json:"unsampled"`
+}
+
+// startStandaloneTransaction starts a transaction for a backend or a proxy called without one, when enabled.
+// The decision of the router middleware comes first: the excluded requests are never instrumented and the requests
+// it did not sample are only instrumented with Unsampled. The calls that did not go through the router are sampled
+// with the rate.
+func startStandaloneTransaction(ctx context.Context, name string) (context.Context, Transaction) {
+	conf := app.Config.StandaloneTransactions
+	if !conf.Enabled {
+		return ctx, nil
+	}
+	excluded, sampledOut := routerDecision(ctx)
+	if excluded {
+		return ctx, nil
+	}
+	if sampledOut {
+		if !conf.Unsampled {
+			return ctx, nil
+		}
+	} else if !sampled(app.SamplingRate()) {
+		return ctx, nil
+	}
+
+	ctx, txn := StartBackgroundTransaction(ctx, name)
+	if txn != nil {
+		addAttribute(txn, "standalone", true)
+	}
+	return ctx, txn
+}
+
+// routerDecision returns whether the router middleware excluded the request of the context or did not sample it
+func routerDecision(ctx context.Context) (excluded, sampledOut bool) {
+	excluded, _ = ctx.Value(excludedKey).(bool)
+	sampledOut, _ = ctx.Value(sampledOutKey).(bool)
+	return excluded, sampledOut
+}
+
+// backendTransactionName names the standalone transactions of the backends Backend/{host}{url_pattern}
+func backendTransactionName(req *proxy.Request, urlPattern string) string {
+	host := ""
+	if req.URL != nil {
+		host = req.URL.Host
+	}
+	return "Backend/" + host + urlPattern
+}
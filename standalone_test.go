@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendFactory_standaloneTransactions(t *testing.T) {
+	tests := []struct {
+		name             string
+		conf             StandaloneTransactionConfig
+		rate             int
+		routerKey        string
+		wantTransactions []string
+	}{
+		{
+			name:             "given standalone transactions are disabled, it should not start a transaction",
+			conf:             StandaloneTransactionConfig{},
+			rate:             100,
+			wantTransactions: []string{},
+		},
+		{
+			name:             "given a call without a transaction, it should start one named from the backend",
+			conf:             StandaloneTransactionConfig{Enabled: true},
+			rate:             100,
+			wantTransactions: []string{"Backend/backend:8080/users/{id}"},
+		},
+		{
+			name:             "given a call not sampled with the rate, it should not start a transaction",
+			conf:             StandaloneTransactionConfig{Enabled: true},
+			rate:             0,
+			wantTransactions: []string{},
+		},
+		{
+			name:             "given a request not sampled by the router, it should not start a transaction",
+			conf:             StandaloneTransactionConfig{Enabled: true},
+			rate:             100,
+			routerKey:        sampledOutKey,
+			wantTransactions: []string{},
+		},
+		{
+			name:             "given the unsampled requests are enabled, it should start a transaction for them",
+			conf:             StandaloneTransactionConfig{Enabled: true, Unsampled: true},
+			rate:             0,
+			routerKey:        sampledOutKey,
+			wantTransactions: []string{"Backend/backend:8080/users/{id}"},
+		},
+		{
+			name:             "given an excluded request, it should never start a transaction",
+			conf:             StandaloneTransactionConfig{Enabled: true, Unsampled: true},
+			rate:             100,
+			routerKey:        excludedKey,
+			wantTransactions: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				recorder := NewRecorder()
+				app = &Application{
+					TransactionManager: recorder,
+					NRApplication:      recorder,
+					Config:             Config{InstrumentationRate: tt.rate, StandaloneTransactions: tt.conf},
+				}
+				defer func() { app = nil }()
+
+				bf := BackendFactory(
+					"backend", func(*config.Backend) proxy.Proxy {
+						return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+							return &proxy.Response{IsComplete: true, Metadata: proxy.Metadata{StatusCode: http.StatusOK}}, nil
+						}
+					},
+				)
+				p := bf(&config.Backend{URLPattern: "/users/{id}"})
+
+				c := &gin.Context{}
+				if tt.routerKey != "" {
+					c.Set(tt.routerKey, true)
+				}
+				backendURL, _ := url.Parse("http://backend:8080/users/1")
+				_, err := p(c, &proxy.Request{Method: http.MethodGet, URL: backendURL, Headers: map[string][]string{}})
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				names := []string{}
+				for _, txn := range recorder.Transactions() {
+					names = append(names, txn.Name)
+					assert.True(t, txn.Ended)
+					assert.Equal(t, true, txn.Attributes["standalone"])
+					assert.Equal(t, []string{"External/backend:8080/http/GET"}, txn.SegmentNames())
+				}
+				assert.Equal(t, tt.wantTransactions, names)
+			},
+		)
+	}
+}
+
+func TestNewProxyMiddleware_standaloneTransaction(t *testing.T) {
+	recorder := NewRecorder()
+	app = &Application{
+		TransactionManager: recorder,
+		NRApplication:      recorder,
+		Config: Config{
+			InstrumentationRate:    100,
+			StandaloneTransactions: StandaloneTransactionConfig{Enabled: true},
+		},
+	}
+	defer func() { app = nil }()
+
+	backend := NewBackend(
+		"backend", func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{IsComplete: true, Metadata: proxy.Metadata{StatusCode: http.StatusOK}}, nil
+		},
+	)
+	p := NewProxyMiddleware("(proxy) /users")(backend)
+
+	backendURL, _ := url.Parse("http://backend:8080/users/1")
+	_, err := p(context.Background(), &proxy.Request{Method: http.MethodGet, URL: backendURL, Headers: map[string][]string{}})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	txns := recorder.Transactions()
+	if assert.Len(t, txns, 1) {
+		assert.Equal(t, "Proxy/(proxy) /users", txns[0].Name)
+		assert.Equal(t, []string{"(proxy) /users", "External/backend:8080/http/GET"}, txns[0].SegmentNames())
+	}
+}
@@ -0,0 +1,218 @@
+package metrics
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+)
+
+const maskedSecret = "****"
+
+// Status is the state of the instrumentation reported by the status endpoint
+type Status struct {
+	Exporter   string            `json:"exporter"`
+	Connection ConnectionStatus  `json:"connection"`
+	Config     Config            `json:"config"`
+	NewRelic   map[string]string `json:"newrelic,omitempty"`
+	Sampling   SamplingStatus    `json:"sampling"`
+	Dropped    DroppedStatus     `json:"dropped"`
+	Endpoints  []EndpointStatus  `json:"endpoints"`
+	Backends   []BackendStatus   `json:"backends"`
+}
+
+// SamplingStatus is the sampling of the requests
+type SamplingStatus struct {
+	Rate       int `json:"rate"`
+	Configured int `json:"configured"`
+}
+
+// DroppedStatus counts the requests whose data is not sent
+type DroppedStatus struct {
+	// UnsampledRequests is the number of requests not selected by the sampling rate
+	UnsampledRequests uint64 `json:"unsampled_requests"`
+	// IgnoredTransactions is the number of transactions of unsampled requests ignored because they were not slow
+	IgnoredTransactions uint64 `json:"ignored_transactions"`
+	// ExcludedRequests is the number of requests matching the exclusion rules
+	ExcludedRequests uint64 `json:"excluded_requests"`
+}
+
+// EndpointStatus is an instrumented endpoint
+type EndpointStatus struct {
+	Method               string                    `json:"method"`
+	Endpoint             string                    `json:"endpoint"`
+	SlowRequestThreshold string                    `json:"slow_request_threshold,omitempty"`
+	StatusCodes          *StatusCodeClassification `json:"status_codes,omitempty"`
+}
+
+// BackendStatus is an instrumented backend
+type BackendStatus struct {
+	Protocol    string                    `json:"protocol"`
+	Method      string                    `json:"method"`
+	Hosts       []string                  `json:"hosts"`
+	URLPattern  string                    `json:"url_pattern"`
+	StatusCodes *StatusCodeClassification `json:"status_codes,omitempty"`
+}
+
+// instrumentationState keeps track of the instrumented endpoints and backends and of the dropped requests.
+// The dropped requests are counted on every request, so they are atomic counters.
+type instrumentationState struct {
+	unsampledRequests   uint64
+	ignoredTransactions uint64
+	excludedRequests    uint64
+
+	mu        sync.Mutex
+	endpoints map[string]EndpointStatus
+	backends  []BackendStatus
+}
+
+func (s *instrumentationState) addEndpoint(endpoint EndpointStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.endpoints == nil {
+		s.endpoints = map[string]EndpointStatus{}
+	}
+	s.endpoints[routeKey(endpoint.Method, endpoint.Endpoint)] = endpoint
+}
+
+func (s *instrumentationState) addBackend(backend BackendStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.backends = append(s.backends, backend)
+}
+
+func (s *instrumentationState) unsampledRequest() {
+	atomic.AddUint64(&s.unsampledRequests, 1)
+}
+
+func (s *instrumentationState) excludedRequest() {
+	atomic.AddUint64(&s.excludedRequests, 1)
+}
+
+func (s *instrumentationState) ignoredTransaction() {
+	atomic.AddUint64(&s.ignoredTransactions, 1)
+}
+
+func (s *instrumentationState) fill(status *Status) {
+	status.Dropped = DroppedStatus{
+		UnsampledRequests:   atomic.LoadUint64(&s.unsampledRequests),
+		IgnoredTransactions: atomic.LoadUint64(&s.ignoredTransactions),
+		ExcludedRequests:    atomic.LoadUint64(&s.excludedRequests),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status.Endpoints = make([]EndpointStatus, 0, len(s.endpoints))
+	for _, e := range s.endpoints {
+		status.Endpoints = append(status.Endpoints, e)
+	}
+	sort.Slice(
+		status.Endpoints, func(i, j int) bool {
+			return routeKey(status.Endpoints[i].Method, status.Endpoints[i].Endpoint) <
+				routeKey(status.Endpoints[j].Method, status.Endpoints[j].Endpoint)
+		},
+	)
+	status.Backends = append(make([]BackendStatus, 0, len(s.backends)), s.backends...)
+}
+
+// Status returns the state of the instrumentation, with the secrets of the config masked
+func (a *Application) Status() Status {
+	status := Status{
+		Exporter:   a.Config.Exporter,
+		Connection: a.ConnectionStatus(),
+		Config:     maskedConfig(a.Config),
+		Sampling:   SamplingStatus{Rate: a.SamplingRate(), Configured: a.Config.InstrumentationRate},
+	}
+	if status.Exporter == "" {
+		status.Exporter = ExporterNewRelic
+	}
+	if status.Exporter == ExporterNewRelic {
+		status.NewRelic = map[string]string{
+			"app_name":    os.Getenv("NEW_RELIC_APP_NAME"),
+			"license_key": maskSecret(os.Getenv("NEW_RELIC_LICENSE_KEY")),
+		}
+	}
+	a.instrumentation.fill(&status)
+
+	return status
+}
+
+// StatusHandler responds with the state of the instrumentation of the registered application
+func StatusHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if app == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "the NR module is not registered"})
+			return
+		}
+		c.JSON(http.StatusOK, app.Status())
+	}
+}
+
+// RegisterStatusEndpoint adds the status endpoint to the engine when the status_endpoint and the admin_token are
+// configured. The endpoint exposes the config, so the engine should not be reachable from the public network.
+func RegisterStatusEndpoint(engine gin.IRoutes) {
+	if app == nil || app.Config.StatusEndpoint == "" {
+		return
+	}
+	if handlers, ok := adminHandlers(app.Config.StatusEndpoint, StatusHandler()); ok {
+		engine.GET(app.Config.StatusEndpoint, handlers...)
+	}
+}
+
+func registerEndpoint(cfg *config.EndpointConfig, classification *StatusCodeClassification, threshold string) {
+	app.instrumentation.addEndpoint(
+		EndpointStatus{
+			Method:               strings.ToUpper(cfg.Method),
+			Endpoint:             cfg.Endpoint,
+			SlowRequestThreshold: threshold,
+			StatusCodes:          classification,
+		},
+	)
+}
+
+func registerBackend(protocol string, cfg *config.Backend, classification *StatusCodeClassification) {
+	app.instrumentation.addBackend(
+		BackendStatus{
+			Protocol:    protocol,
+			Method:      strings.ToUpper(cfg.Method),
+			Hosts:       cfg.Host,
+			URLPattern:  cfg.URLPattern,
+			StatusCodes: classification,
+		},
+	)
+}
+
+func maskedConfig(conf Config) Config {
+	conf.AdminToken = maskSecret(conf.AdminToken)
+	conf.HashKey = maskSecret(conf.HashKey)
+	if len(conf.OTLP.Headers) == 0 {
+		return conf
+	}
+
+	headers := make(map[string]string, len(conf.OTLP.Headers))
+	for k, v := range conf.OTLP.Headers {
+		headers[k] = maskSecret(v)
+	}
+	conf.OTLP.Headers = headers
+
+	return conf
+}
+
+// maskSecret only keeps the last characters of the secret
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) <= 8 {
+		return maskedSecret
+	}
+	return maskedSecret + secret[len(secret)-4:]
+}
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/encoding"
+	"github.com/luraproject/lura/v2/transport/http/client"
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// StatusCodeClassification defines which status codes are reported as errors.
+// When ErrorStatusCodes is empty, every status code from 400 is an error.
+// ExpectedStatusCodes are not errors, the transaction only gets the error.expected attribute.
+type StatusCodeClassification struct {
+	ErrorStatusCodes    []int `json:"error_status_codes"`
+	ExpectedStatusCodes []int `json:"expected_status_codes"`
+}
+
+type statusCodeClass int
+
+const (
+	statusCodeOK statusCodeClass = iota
+	statusCodeError
+	statusCodeExpected
+)
+
+type statusCodeConfig struct {
+	StatusCodes *StatusCodeClassification `json:"status_codes"`
+}
+
+func (s *StatusCodeClassification) classify(code int) statusCodeClass {
+	if s == nil || code == 0 {
+		return statusCodeOK
+	}
+	if containsStatusCode(s.ExpectedStatusCodes, code) {
+		return statusCodeExpected
+	}
+	if len(s.ErrorStatusCodes) == 0 {
+		if code >= http.StatusBadRequest {
+			return statusCodeError
+		}
+		return statusCodeOK
+	}
+	if containsStatusCode(s.ErrorStatusCodes, code) {
+		return statusCodeError
+	}
+	return statusCodeOK
+}
+
+func containsStatusCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// errStatusCodesNotInService is returned when an endpoint or a backend classifies the status codes but the service
+// does not, so the agent still reports them on its own
+var errStatusCodesNotInService = errors.New(
+	"the status_codes are ignored, they must be defined in the service too for the agent to stop reporting them",
+)
+
+// statusCodeClassificationFor returns the classification defined in the endpoint or backend
+// extra_config, falling back to the one defined in the service.
+// The classification is disabled when the service does not define it, as the agent only stops reporting the status
+// codes on its own when it does, and an error is returned when the extra_config defines one.
+func statusCodeClassificationFor(cfg config.ExtraConfig) (*StatusCodeClassification, error) {
+	result := statusCodeConfig{}
+	if err := decodeExtraConfig(cfg, &result); err != nil || result.StatusCodes == nil {
+		return app.Config.StatusCodes, nil
+	}
+	if app.Config.StatusCodes == nil {
+		return nil, errStatusCodesNotInService
+	}
+	return result.StatusCodes, nil
+}
+
+// noticeStatusCode reports the status code to the transaction according to the classification.
+// The agent counts every noticed error in the error rate, so the expected status codes are not noticed,
+// the transaction only gets the error.expected attribute.
+func noticeStatusCode(txn Transaction, classification *StatusCodeClassification, code int, attrs map[string]interface{}) {
+	switch classification.classify(code) {
+	case statusCodeOK:
+		return
+	case statusCodeExpected:
+		addAttribute(txn, "error.expected", true)
+		return
+	}
+
+	errAttrs := map[string]interface{}{"http.statusCode": code}
+	for k, v := range attrs {
+		errAttrs[k] = v
+	}
+	noticeError(
+		txn,
+		newrelic.Error{
+			Message:    fmt.Sprintf("%d %s", code, http.StatusText(code)),
+			Class:      strconv.Itoa(code),
+			Attributes: errAttrs,
+		},
+	)
+}
+
+// backendReportsStatusCodes tells whether the lura http proxy of the backend returns the status codes of the failed
+// responses. The default status handler returns an error without it, so the backend must set return_error_details or
+// return_error_code in the github.com/devopsfaith/krakend/http namespace, or use the no-op encoding.
+func backendReportsStatusCodes(cfg *config.Backend) bool {
+	if cfg.Encoding == encoding.NOOP {
+		return true
+	}
+	e, ok := cfg.ExtraConfig[client.Namespace].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	if v, ok := e["return_error_details"].(string); ok && v != "" {
+		return true
+	}
+	v, ok := e["return_error_code"].(bool)
+	return ok && v
+}
+
+// errorStatusCode returns the status code carried by the error returned from a backend, if any.
+func errorStatusCode(err error) int {
+	var statusErr interface{ StatusCode() int }
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode()
+	}
+	return 0
+}
+
+// statusCodeClassificationOption stops the agent from recording the status codes as errors on its own
+// when the gateway classifies them.
+func statusCodeClassificationOption(classification *StatusCodeClassification) newrelic.ConfigOption {
+	return func(c *newrelic.Config) {
+		if classification == nil {
+			return
+		}
+		for code := http.StatusBadRequest; code < 600; code++ {
+			c.ErrorCollector.IgnoreStatusCodes = append(c.ErrorCollector.IgnoreStatusCodes, code)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusCodeClassification_classify(t *testing.T) {
+	tests := []struct {
+		name           string
+		classification *StatusCodeClassification
+		code           int
+		want           statusCodeClass
+	}{
+		{
+			name:           "given no classification, it should not classify any status code",
+			classification: nil,
+			code:           500,
+			want:           statusCodeOK,
+		},
+		{
+			name:           "given no error status codes, it should classify status codes from 400 as errors",
+			classification: &StatusCodeClassification{},
+			code:           404,
+			want:           statusCodeError,
+		},
+		{
+			name:           "given no error status codes, it should not classify status codes below 400 as errors",
+			classification: &StatusCodeClassification{},
+			code:           302,
+			want:           statusCodeOK,
+		},
+		{
+			name: "given an expected status code, it should classify it as expected",
+			classification: &StatusCodeClassification{
+				ExpectedStatusCodes: []int{404},
+			},
+			code: 404,
+			want: statusCodeExpected,
+		},
+		{
+			name: "given error status codes, it should only classify those as errors",
+			classification: &StatusCodeClassification{
+				ErrorStatusCodes: []int{429, 500},
+			},
+			code: 429,
+			want: statusCodeError,
+		},
+		{
+			name: "given error status codes, it should not classify the others as errors",
+			classification: &StatusCodeClassification{
+				ErrorStatusCodes: []int{429, 500},
+			},
+			code: 400,
+			want: statusCodeOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				assert.Equal(t, tt.want, tt.classification.classify(tt.code))
+			},
+		)
+	}
+}
+
+func Test_statusCodeClassificationFor(t *testing.T) {
+	serviceClassification := &StatusCodeClassification{ErrorStatusCodes: []int{500}}
+	tests := []struct {
+		name    string
+		app     *Application
+		cfg     config.ExtraConfig
+		want    *StatusCodeClassification
+		wantErr error
+	}{
+		{
+			name: "given the classification is not defined in the service, it should ignore the extra config",
+			app:  &Application{},
+			cfg: config.ExtraConfig{
+				Namespace: map[string]interface{}{
+					"status_codes": map[string]interface{}{"expected_status_codes": []int{404}},
+				},
+			},
+			want:    nil,
+			wantErr: errStatusCodesNotInService,
+		},
+		{
+			name: "given the classification is defined nowhere, it should be disabled",
+			app:  &Application{},
+			cfg:  config.ExtraConfig{},
+			want: nil,
+		},
+		{
+			name: "given an override in the extra config, it should use it",
+			app:  &Application{Config: Config{StatusCodes: serviceClassification}},
+			cfg: config.ExtraConfig{
+				Namespace: map[string]interface{}{
+					"status_codes": map[string]interface{}{"expected_status_codes": []int{404}},
+				},
+			},
+			want: &StatusCodeClassification{ExpectedStatusCodes: []int{404}},
+		},
+		{
+			name: "given no override in the extra config, it should use the service classification",
+			app:  &Application{Config: Config{StatusCodes: serviceClassification}},
+			cfg:  config.ExtraConfig{},
+			want: serviceClassification,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				app = tt.app
+				got, err := statusCodeClassificationFor(tt.cfg)
+				assert.Equal(t, tt.want, got)
+				assert.Equal(t, tt.wantErr, err)
+			},
+		)
+	}
+}
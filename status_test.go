@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterStatusEndpoint(t *testing.T) {
+	recorder := NewRecorder()
+	app = &Application{
+		TransactionManager: recorder,
+		NRApplication:      recorder,
+		Config: Config{
+			Exporter:             ExporterOTLP,
+			InstrumentationRate:  0,
+			SlowRequestThreshold: "1s",
+			StatusEndpoint:       "/__status/newrelic",
+			AdminToken:           "0123456789s3cr3t",
+			OTLP:                 OTLPConfig{Headers: map[string]string{"api-key": "0123456789abcdef"}},
+		},
+		slowRequestThreshold: time.Second,
+		connection:           connectionState{status: ConnectionStatus{Attempts: 1}},
+	}
+	defer func() { app = nil }()
+
+	bf := BackendFactory(
+		"backend", func(*config.Backend) proxy.Proxy {
+			return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+				return &proxy.Response{}, nil
+			}
+		},
+	)
+	p := bf(&config.Backend{Method: "get", Host: []string{"http://backend:8080"}, URLPattern: "/users"})
+	handler := HandlerFactory(
+		func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+			return func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			}
+		},
+	)(&config.EndpointConfig{Method: http.MethodGet, Endpoint: "/users"}, p)
+
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	RegisterStatusEndpoint(e)
+	e.Use(Middleware())
+	e.GET("/users", handler)
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users", nil))
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/__status/newrelic", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/__status/newrelic", nil)
+	req.Header.Set("Authorization", "Bearer 0123456789s3cr3t")
+	e.ServeHTTP(w, req)
+	if !assert.Equal(t, http.StatusOK, w.Code) {
+		return
+	}
+
+	var status Status
+	if !assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &status)) {
+		return
+	}
+	assert.Equal(t, ExporterOTLP, status.Exporter)
+	assert.True(t, status.Connection.Connected)
+	assert.Equal(t, "****cdef", status.Config.OTLP.Headers["api-key"])
+	assert.Equal(t, "****cr3t", status.Config.AdminToken)
+	assert.Nil(t, status.NewRelic)
+	assert.Equal(t, SamplingStatus{Rate: 0}, status.Sampling)
+	assert.Equal(t, DroppedStatus{UnsampledRequests: 1, IgnoredTransactions: 1}, status.Dropped)
+	assert.Equal(
+		t, []EndpointStatus{{Method: http.MethodGet, Endpoint: "/users", SlowRequestThreshold: "1s"}}, status.Endpoints,
+	)
+	assert.Equal(
+		t,
+		[]BackendStatus{{Protocol: "http", Method: http.MethodGet, Hosts: []string{"http://backend:8080"}, URLPattern: "/users"}},
+		status.Backends,
+	)
+	assert.Equal(t, "0123456789abcdef", app.Config.OTLP.Headers["api-key"])
+}
+
+func TestRegisterStatusEndpoint_notConfigured(t *testing.T) {
+	defer func() { app = nil }()
+
+	for _, conf := range []Config{{}, {StatusEndpoint: "/__status/newrelic"}} {
+		app = &Application{Config: conf}
+
+		gin.SetMode(gin.TestMode)
+		e := gin.New()
+		RegisterStatusEndpoint(e)
+
+		assert.Empty(t, e.Routes())
+	}
+}
+
+func Test_maskSecret(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		want   string
+	}{
+		{
+			name:   "given an empty secret, it should return an empty string",
+			secret: "",
+			want:   "",
+		},
+		{
+			name:   "given a short secret, it should mask it entirely",
+			secret: "secret",
+			want:   "****",
+		},
+		{
+			name:   "given a long secret, it should only keep its last characters",
+			secret: "0123456789abcdef",
+			want:   "****cdef",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				assert.Equal(t, tt.want, maskSecret(tt.secret))
+			},
+		)
+	}
+}
@@ -0,0 +1,418 @@
+package metrics
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StreamingConnectionEventType is the custom event recorded for the WebSocket and SSE connections
+const StreamingConnectionEventType = "KrakendStreamingConnection"
+
+const (
+	protocolWebSocket = "websocket"
+	protocolSSE       = "sse"
+
+	closeReasonClient       = "client"
+	closeReasonServer       = "server"
+	closeReasonDisconnected = "disconnected"
+	closeReasonCompleted    = "completed"
+
+	// streamingConnectionKey marks the requests answered with a streaming connection
+	streamingConnectionKey = "krakendNewRelicStreamingConnection"
+
+	wsOpcodeContinuation = 0x0
+	wsOpcodeText         = 0x1
+	wsOpcodeBinary       = 0x2
+	wsOpcodeClose        = 0x8
+)
+
+// StreamingConfig configures the instrumentation of the WebSocket and SSE connections
+type StreamingConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// streamingProtocol returns the protocol of the long-lived connection the request asks for, empty for the other requests.
+// It is only a hint, the connection is handled as streaming once the response confirms it.
+func streamingProtocol(r *http.Request) string {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		return protocolWebSocket
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return protocolSSE
+	}
+	return ""
+}
+
+// streamingMW records the WebSocket and SSE connections as a KrakendStreamingConnection custom event
+// when they are closed, instead of a transaction lasting as long as the connection.
+// The connections are only detected from the response, the hijacked connection of a WebSocket or
+// the text/event-stream content type of SSE, so the callers can not skip the transactions with their headers.
+func streamingMW(next gin.HandlerFunc) gin.HandlerFunc {
+	if !app.Config.Streaming.Enabled {
+		return next
+	}
+	return func(c *gin.Context) {
+		protocol := streamingProtocol(c.Request)
+		if protocol == "" {
+			next(c)
+			return
+		}
+
+		w := &streamingWriter{ResponseWriter: c.Writer, protocol: protocol, c: c}
+		c.Writer = w
+		start := time.Now()
+		next(c)
+		if w.isStreaming() {
+			recordStreamingConnection(c, w, time.Since(start))
+		}
+	}
+}
+
+func recordStreamingConnection(c *gin.Context, w *streamingWriter, elapsed time.Duration) {
+	stats := w.stats(c)
+	params := map[string]interface{}{
+		"endpoint":         c.FullPath(),
+		"method":           c.Request.Method,
+		"protocol":         w.protocol,
+		"durationMs":       elapsed.Milliseconds(),
+		"statusCode":       stats.statusCode,
+		"messagesSent":     stats.messagesSent,
+		"messagesReceived": stats.messagesReceived,
+		"bytesSent":        stats.bytesSent,
+		"bytesReceived":    stats.bytesReceived,
+		"closeReason":      stats.closeReason,
+	}
+	if stats.closeCode != 0 {
+		params["closeCode"] = stats.closeCode
+	}
+	if id := c.GetString(clientIDKey); id != "" {
+		params["client.id"] = id
+	}
+	app.RecordCustomEvent(StreamingConnectionEventType, params)
+}
+
+type streamingStats struct {
+	statusCode       int
+	messagesSent     int64
+	messagesReceived int64
+	bytesSent        int64
+	bytesReceived    int64
+	closeReason      string
+	closeCode        int
+}
+
+// streamingWriter counts the messages of the connection. The SSE events are counted as they are written,
+// the WebSocket frames are counted on the hijacked connection.
+type streamingWriter struct {
+	gin.ResponseWriter
+	protocol string
+	c        *gin.Context
+
+	mu          sync.Mutex
+	streaming   bool
+	hijacked    bool
+	bytesSent   int64
+	events      int64
+	lastNewline bool
+	sent        wsFrameParser
+	received    wsFrameParser
+	firstClose  string
+}
+
+// detect tells whether the response is an SSE stream once its headers are sent
+func (w *streamingWriter) detect() {
+	if w.protocol == protocolSSE && !w.isStreaming() &&
+		strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		w.startStreaming()
+	}
+}
+
+// startStreaming ignores the transaction of the request, the connection is recorded as a custom event instead
+func (w *streamingWriter) startStreaming() {
+	w.mu.Lock()
+	w.streaming = true
+	w.mu.Unlock()
+
+	w.c.Set(streamingConnectionKey, true)
+	if txn := app.TransactionManager.TransactionFromContext(w.c); txn != nil {
+		ignoreTransaction(txn)
+	}
+}
+
+func (w *streamingWriter) isStreaming() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.streaming
+}
+
+func (w *streamingWriter) WriteHeaderNow() {
+	w.detect()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *streamingWriter) Flush() {
+	w.detect()
+	w.ResponseWriter.Flush()
+}
+
+func (w *streamingWriter) Write(b []byte) (int, error) {
+	w.detect()
+	n, err := w.ResponseWriter.Write(b)
+	w.countEvents(b[:n])
+	return n, err
+}
+
+func (w *streamingWriter) WriteString(s string) (int, error) {
+	w.detect()
+	n, err := w.ResponseWriter.WriteString(s)
+	w.countEvents([]byte(s[:n]))
+	return n, err
+}
+
+// countEvents counts the SSE events, terminated by an empty line
+func (w *streamingWriter) countEvents(b []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.bytesSent += int64(len(b))
+	for _, c := range b {
+		switch c {
+		case '\n':
+			if w.lastNewline {
+				w.events++
+			}
+			w.lastNewline = true
+		case '\r':
+		default:
+			w.lastNewline = false
+		}
+	}
+}
+
+func (w *streamingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := w.ResponseWriter.Hijack()
+	if err != nil {
+		return conn, brw, err
+	}
+
+	w.mu.Lock()
+	w.hijacked = true
+	// the handshake response is written on the connection before the frames
+	w.sent.handshake = true
+	w.mu.Unlock()
+	if w.protocol == protocolWebSocket {
+		w.startStreaming()
+	}
+
+	// the reads go through the original reader, which may hold data already received
+	counted := &countingConn{Conn: conn, reader: brw.Reader, writer: w}
+	return counted, bufio.NewReadWriter(bufio.NewReader(counted), bufio.NewWriter(counted)), nil
+}
+
+func (w *streamingWriter) frames(b []byte, received bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	parser, side := &w.sent, closeReasonServer
+	if received {
+		parser, side = &w.received, closeReasonClient
+	}
+	parser.write(b)
+	if parser.closed && w.firstClose == "" {
+		w.firstClose = side
+	}
+}
+
+func (w *streamingWriter) stats(c *gin.Context) streamingStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.protocol == protocolSSE {
+		reason := closeReasonCompleted
+		if c.Request.Context().Err() != nil {
+			reason = closeReasonDisconnected
+		}
+		return streamingStats{
+			statusCode:   w.Status(),
+			messagesSent: w.events,
+			bytesSent:    w.bytesSent,
+			closeReason:  reason,
+		}
+	}
+
+	stats := streamingStats{
+		statusCode:       http.StatusSwitchingProtocols,
+		messagesSent:     w.sent.messages,
+		messagesReceived: w.received.messages,
+		bytesSent:        w.sent.bytes,
+		bytesReceived:    w.received.bytes,
+		closeReason:      w.firstClose,
+	}
+	switch w.firstClose {
+	case closeReasonClient:
+		stats.closeCode = w.received.closeCode
+	case closeReasonServer:
+		stats.closeCode = w.sent.closeCode
+	default:
+		stats.closeReason = closeReasonDisconnected
+	}
+	return stats
+}
+
+// countingConn passes the bytes read and written on the hijacked connection to the frame parsers
+type countingConn struct {
+	net.Conn
+	reader *bufio.Reader
+	writer *streamingWriter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	c.writer.frames(b[:n], true)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.writer.frames(b[:n], false)
+	return n, err
+}
+
+// wsFrameParser follows the WebSocket frames of one direction of the connection, counting the messages
+// and keeping the status code of the close frame.
+type wsFrameParser struct {
+	// handshake skips the HTTP response preceding the frames
+	handshake bool
+	crlf      int
+
+	bytes     int64
+	messages  int64
+	closed    bool
+	closeCode int
+
+	header    []byte
+	inPayload bool
+	remaining uint64
+	offset    uint64
+	opcode    byte
+	fin       bool
+	masked    bool
+	mask      [4]byte
+	closeBody []byte
+}
+
+func (p *wsFrameParser) write(b []byte) {
+	p.bytes += int64(len(b))
+	for len(b) > 0 {
+		if p.handshake {
+			p.skipHandshake(b[0])
+			b = b[1:]
+			continue
+		}
+		if !p.inPayload {
+			p.header = append(p.header, b[0])
+			b = b[1:]
+			p.parseHeader()
+			continue
+		}
+
+		n := uint64(len(b))
+		if n > p.remaining {
+			n = p.remaining
+		}
+		if p.opcode == wsOpcodeClose {
+			for i := uint64(0); i < n && len(p.closeBody) < 2; i++ {
+				c := b[i]
+				if p.masked {
+					c ^= p.mask[(p.offset+i)%4]
+				}
+				p.closeBody = append(p.closeBody, c)
+			}
+		}
+		b = b[n:]
+		p.offset += n
+		p.remaining -= n
+		if p.remaining == 0 {
+			p.endFrame()
+		}
+	}
+}
+
+// skipHandshake looks for the empty line ending the HTTP response
+func (p *wsFrameParser) skipHandshake(c byte) {
+	switch {
+	case c == '\r' && p.crlf%2 == 0, c == '\n' && p.crlf%2 == 1:
+		p.crlf++
+	case c == '\r':
+		p.crlf = 1
+	default:
+		p.crlf = 0
+	}
+	if p.crlf == 4 {
+		p.handshake = false
+	}
+}
+
+// parseHeader parses the header once all its bytes are received
+func (p *wsFrameParser) parseHeader() {
+	if len(p.header) < 2 {
+		return
+	}
+	size := 2
+	switch p.header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	masked := p.header[1]&0x80 != 0
+	if masked {
+		size += 4
+	}
+	if len(p.header) < size {
+		return
+	}
+
+	p.fin = p.header[0]&0x80 != 0
+	p.opcode = p.header[0] & 0x0f
+	p.masked = masked
+	switch p.header[1] & 0x7f {
+	case 126:
+		p.remaining = uint64(binary.BigEndian.Uint16(p.header[2:4]))
+	case 127:
+		p.remaining = binary.BigEndian.Uint64(p.header[2:10])
+	default:
+		p.remaining = uint64(p.header[1] & 0x7f)
+	}
+	if masked {
+		copy(p.mask[:], p.header[size-4:size])
+	}
+	p.header = p.header[:0]
+	p.offset = 0
+	p.closeBody = p.closeBody[:0]
+	p.inPayload = true
+	if p.remaining == 0 {
+		p.endFrame()
+	}
+}
+
+func (p *wsFrameParser) endFrame() {
+	p.inPayload = false
+	switch p.opcode {
+	case wsOpcodeContinuation, wsOpcodeText, wsOpcodeBinary:
+		if p.fin {
+			p.messages++
+		}
+	case wsOpcodeClose:
+		p.closed = true
+		if len(p.closeBody) == 2 {
+			p.closeCode = int(binary.BigEndian.Uint16(p.closeBody))
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package metrics
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// wsFrame encodes a final WebSocket frame, masked as the clients send them
+func wsFrame(opcode byte, payload []byte, masked bool) []byte {
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	default:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	frame[1] |= 0x80
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, c := range payload {
+		frame = append(frame, c^mask[i%4])
+	}
+	return frame
+}
+
+// readWSFrame reads a small frame, returning its opcode and unmasked payload
+func readWSFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	var mask []byte
+	if header[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(r, mask); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, header[1]&0x7f)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		if mask != nil {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return header[0] & 0x0f, payload, nil
+}
+
+// echoWebSocket echoes the text messages until the client closes the connection
+func echoWebSocket(c *gin.Context) {
+	conn, brw, err := c.Writer.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	for {
+		opcode, payload, err := readWSFrame(brw)
+		if err != nil {
+			return
+		}
+		if opcode == wsOpcodeClose {
+			_, _ = conn.Write(wsFrame(wsOpcodeClose, payload, false))
+			return
+		}
+		_, _ = conn.Write(wsFrame(opcode, payload, false))
+	}
+}
+
+func TestMiddleware_webSocket(t *testing.T) {
+	recorder := NewRecorder()
+	app = &Application{
+		TransactionManager: recorder,
+		NRApplication:      recorder,
+		Config:             Config{InstrumentationRate: 100, Streaming: StreamingConfig{Enabled: true}},
+	}
+	defer func() { app = nil }()
+
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.Use(Middleware())
+	e.GET("/ws", echoWebSocket)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, _ = conn.Write(
+		[]byte(
+			"GET /ws HTTP/1.1\r\nHost: gateway\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+				"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n",
+		),
+	)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	for _, message := range []string{"hello", "gopher"} {
+		_, _ = conn.Write(wsFrame(wsOpcodeText, []byte(message), true))
+		_, payload, err := readWSFrame(r)
+		assert.NoError(t, err)
+		assert.Equal(t, message, string(payload))
+	}
+	_, _ = conn.Write(wsFrame(wsOpcodeClose, []byte{0x03, 0xe8}, true))
+	opcode, _, err := readWSFrame(r)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(wsOpcodeClose), opcode)
+
+	// the event is recorded once the handler returns, after closing the connection
+	var events []RecordedEvent
+	assert.Eventually(
+		t, func() bool {
+			events = recorder.Events(StreamingConnectionEventType)
+			return len(events) == 1
+		}, time.Second, 10*time.Millisecond,
+	)
+	if len(events) != 1 {
+		return
+	}
+	if transactions := recorder.Transactions(); assert.Len(t, transactions, 1) {
+		assert.True(t, transactions[0].Ignored)
+	}
+	params := events[0].Params
+	assert.Equal(t, "/ws", params["endpoint"])
+	assert.Equal(t, protocolWebSocket, params["protocol"])
+	assert.Equal(t, http.StatusSwitchingProtocols, params["statusCode"])
+	assert.Equal(t, int64(2), params["messagesSent"])
+	assert.Equal(t, int64(2), params["messagesReceived"])
+	assert.Equal(t, closeReasonClient, params["closeReason"])
+	assert.Equal(t, 1000, params["closeCode"])
+}
+
+func TestMiddleware_streaming(t *testing.T) {
+	tests := []struct {
+		name             string
+		conf             StreamingConfig
+		headers          map[string]string
+		handler          gin.HandlerFunc
+		wantTransactions int
+		wantIgnored      bool
+		wantParams       map[string]interface{}
+	}{
+		{
+			name:    "given a server-sent events request, it should record the events sent",
+			conf:    StreamingConfig{Enabled: true},
+			headers: map[string]string{"Accept": "text/event-stream"},
+			handler: func(c *gin.Context) {
+				c.Header("Content-Type", "text/event-stream")
+				_, _ = c.Writer.WriteString("data: hello\n\n")
+				_, _ = c.Writer.Write([]byte("event: update\r\ndata: gopher\r\n\r\n"))
+			},
+			wantTransactions: 1,
+			wantIgnored:      true,
+			wantParams: map[string]interface{}{
+				"endpoint":         "/events",
+				"method":           http.MethodGet,
+				"protocol":         protocolSSE,
+				"statusCode":       http.StatusOK,
+				"messagesSent":     int64(2),
+				"messagesReceived": int64(0),
+				"bytesSent":        int64(44),
+				"bytesReceived":    int64(0),
+				"closeReason":      closeReasonCompleted,
+			},
+		},
+		{
+			name:    "given a WebSocket request not upgraded, it should keep its transaction",
+			conf:    StreamingConfig{Enabled: true},
+			headers: map[string]string{"Upgrade": "websocket", "Connection": "keep-alive, Upgrade"},
+			handler: func(c *gin.Context) {
+				c.Status(http.StatusBadRequest)
+			},
+			wantTransactions: 1,
+		},
+		{
+			name:    "given a request accepting server-sent events answered with json, it should keep its transaction",
+			conf:    StreamingConfig{Enabled: true},
+			headers: map[string]string{"Accept": "text/event-stream"},
+			handler: func(c *gin.Context) {
+				c.JSON(http.StatusOK, gin.H{"hello": "gopher"})
+			},
+			wantTransactions: 1,
+		},
+		{
+			name:    "given the streaming instrumentation is disabled, it should start a transaction",
+			headers: map[string]string{"Accept": "text/event-stream"},
+			handler: func(c *gin.Context) {
+				_, _ = c.Writer.WriteString("data: hello\n\n")
+			},
+			wantTransactions: 1,
+		},
+		{
+			name:    "given a regular request, it should start a transaction",
+			conf:    StreamingConfig{Enabled: true},
+			headers: map[string]string{"Accept": "application/json"},
+			handler: func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			},
+			wantTransactions: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				recorder := NewRecorder()
+				app = &Application{
+					TransactionManager: recorder,
+					NRApplication:      recorder,
+					Config:             Config{InstrumentationRate: 100, Streaming: tt.conf},
+				}
+				defer func() { app = nil }()
+
+				gin.SetMode(gin.TestMode)
+				e := gin.New()
+				e.Use(Middleware())
+				e.GET("/events", tt.handler)
+				req := httptest.NewRequest(http.MethodGet, "/events", nil)
+				for k, v := range tt.headers {
+					req.Header.Set(k, v)
+				}
+				e.ServeHTTP(httptest.NewRecorder(), req)
+
+				transactions := recorder.Transactions()
+				if assert.Len(t, transactions, tt.wantTransactions) && tt.wantTransactions > 0 {
+					assert.Equal(t, tt.wantIgnored, transactions[0].Ignored)
+				}
+				events := recorder.Events(StreamingConnectionEventType)
+				if tt.wantParams == nil {
+					assert.Empty(t, events)
+					return
+				}
+				if assert.Len(t, events, 1) {
+					delete(events[0].Params, "durationMs")
+					assert.Equal(t, tt.wantParams, events[0].Params)
+				}
+			},
+		)
+	}
+}
+
+func Test_wsFrameParser(t *testing.T) {
+	fragmented := []byte{wsOpcodeText, 3, 'a', 'b', 'c', 0x80 | wsOpcodeContinuation, 1, 'd'}
+	var stream []byte
+	stream = append(stream, fragmented...)
+	stream = append(stream, wsFrame(0x9, nil, true)...)
+	stream = append(stream, wsFrame(wsOpcodeBinary, make([]byte, 300), true)...)
+	stream = append(stream, wsFrame(wsOpcodeClose, []byte{0x03, 0xe9, 'b', 'y', 'e'}, true)...)
+
+	p := &wsFrameParser{}
+	// feeds the stream in small chunks, splitting the headers and payloads
+	for i := 0; i < len(stream); i += 3 {
+		end := i + 3
+		if end > len(stream) {
+			end = len(stream)
+		}
+		p.write(stream[i:end])
+	}
+
+	assert.Equal(t, int64(2), p.messages)
+	assert.True(t, p.closed)
+	assert.Equal(t, 1001, p.closeCode)
+	assert.Equal(t, int64(len(stream)), p.bytes)
+}
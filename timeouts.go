@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+const (
+	// GatewayTimeoutErrorClass is the class of the errors of the calls cancelled by the endpoint timeout
+	GatewayTimeoutErrorClass = "GatewayTimeout"
+	// BackendTimeoutErrorClass is the class of the errors of the calls timing out on their own, e.g. the client timeout
+	BackendTimeoutErrorClass = "BackendTimeout"
+
+	timeoutSourceGateway = "gateway"
+	timeoutSourceBackend = "backend"
+)
+
+// deadlineAttributes returns the configured endpoint timeout and the time left before the deadline of the context
+// when the call starts, and adds them to the segment
+func deadlineAttributes(ctx context.Context, segment interface{}, timeout time.Duration) map[string]interface{} {
+	attrs := map[string]interface{}{}
+	if timeout > 0 {
+		attrs["endpoint.timeoutMs"] = timeout.Milliseconds()
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		attrs["deadline.remainingMs"] = time.Until(deadline).Milliseconds()
+	}
+	if s, ok := segment.(AttributeAdder); ok {
+		for k, v := range attrs {
+			s.AddAttribute(k, v)
+		}
+	}
+	return attrs
+}
+
+// timeoutSource tells whether the call failed because the endpoint timeout cancelled the context, or because it
+// timed out on its own. It is empty for the other errors.
+func timeoutSource(ctx context.Context, err error) string {
+	if err == nil {
+		return ""
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return timeoutSourceGateway
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return timeoutSourceBackend
+	}
+	return ""
+}
+
+// noticeTimeout notices the timeout of a call with the error class of its source
+func noticeTimeout(txn Transaction, source string, err error, attrs map[string]interface{}) {
+	class := BackendTimeoutErrorClass
+	if source == timeoutSourceGateway {
+		class = GatewayTimeoutErrorClass
+	}
+	errAttrs := map[string]interface{}{"timeout.source": source}
+	for k, v := range attrs {
+		errAttrs[k] = v
+	}
+	addAttribute(txn, "timeout.source", source)
+	noticeError(
+		txn,
+		newrelic.Error{
+			Message:    err.Error(),
+			Class:      class,
+			Attributes: errAttrs,
+		},
+	)
+}
@@ -0,0 +1,202 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/newrelic/go-agent/v3/newrelic"
+	"github.com/stretchr/testify/assert"
+)
+
+// timeoutError is a net.Error timing out, like the errors of the client timeouts
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestBackendFactory_timeouts(t *testing.T) {
+	tests := []struct {
+		name            string
+		backend         proxy.Proxy
+		wantErrorClass  string
+		wantSource      string
+		wantNoErrors    bool
+		wantSegmentAttr map[string]interface{}
+	}{
+		{
+			name: "given the endpoint timeout cancels the call, it should notice a gateway timeout",
+			backend: func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+			wantErrorClass: GatewayTimeoutErrorClass,
+			wantSource:     timeoutSourceGateway,
+		},
+		{
+			name: "given the backend times out on its own, it should notice a backend timeout",
+			backend: func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+				return nil, &url.Error{Op: "Get", URL: "http://backend:8080/users", Err: timeoutError{}}
+			},
+			wantErrorClass: BackendTimeoutErrorClass,
+			wantSource:     timeoutSourceBackend,
+		},
+		{
+			name: "given the backend fails without timing out, it should not notice a timeout",
+			backend: func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+				return nil, errors.New("connection refused")
+			},
+			wantNoErrors: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				recorder := NewRecorder()
+				app = &Application{
+					TransactionManager: recorder,
+					NRApplication:      recorder,
+					Config:             Config{InstrumentationRate: 100},
+				}
+				defer func() { app = nil }()
+
+				bf := BackendFactory(
+					"backend", func(*config.Backend) proxy.Proxy {
+						return tt.backend
+					},
+				)
+				p := bf(&config.Backend{URLPattern: "/users", Timeout: 50 * time.Millisecond})
+
+				ctx, txn := recorder.StartTransactionContext(context.Background(), "/users")
+				ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+				defer cancel()
+				backendURL, _ := url.Parse("http://backend:8080/users")
+				_, err := p(ctx, &proxy.Request{Method: http.MethodGet, URL: backendURL, Headers: map[string][]string{}})
+				txn.End()
+				assert.Error(t, err)
+
+				recorded, _ := recorder.Transaction("/users")
+				segment, ok := recorded.Segment("External/backend:8080/http/GET")
+				if !assert.True(t, ok) {
+					return
+				}
+				assert.Equal(t, int64(50), segment.Attributes["endpoint.timeoutMs"])
+				remaining, ok := segment.Attributes["deadline.remainingMs"].(int64)
+				assert.True(t, ok)
+				assert.True(t, remaining > 0 && remaining <= 50)
+
+				if tt.wantNoErrors {
+					assert.Empty(t, recorded.Errors)
+					assert.NotContains(t, recorded.Attributes, "timeout.source")
+					return
+				}
+				assert.Equal(t, tt.wantSource, segment.Attributes["timeout.source"])
+				assert.Equal(t, tt.wantSource, recorded.Attributes["timeout.source"])
+				if !assert.Len(t, recorded.Errors, 1) {
+					return
+				}
+				noticed, ok := recorded.Errors[0].(newrelic.Error)
+				if assert.True(t, ok) {
+					assert.Equal(t, tt.wantErrorClass, noticed.Class)
+					assert.Equal(t, tt.wantSource, noticed.Attributes["timeout.source"])
+					assert.Equal(t, int64(50), noticed.Attributes["endpoint.timeoutMs"])
+					assert.Equal(t, "http://backend:8080/users", noticed.Attributes["backend.url"])
+				}
+			},
+		)
+	}
+}
+
+func TestProxyFactory_timeout(t *testing.T) {
+	recorder := NewRecorder()
+	app = &Application{
+		TransactionManager: recorder,
+		NRApplication:      recorder,
+		Config:             Config{InstrumentationRate: 100},
+	}
+	defer func() { app = nil }()
+
+	pf := ProxyFactory(
+		"proxy", proxy.FactoryFunc(
+			func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+				return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}, nil
+			},
+		),
+	)
+	p, err := pf.New(&config.EndpointConfig{Endpoint: "/users", Timeout: 20 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ctx, txn := recorder.StartTransactionContext(context.Background(), "/users")
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = p(ctx, &proxy.Request{})
+	txn.End()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	recorded, _ := recorder.Transaction("/users")
+	assert.Equal(t, int64(20), recorded.Attributes["endpoint.timeoutMs"])
+	segment, ok := recorded.Segment("(proxy) /users")
+	if assert.True(t, ok) {
+		assert.Equal(t, int64(20), segment.Attributes["endpoint.timeoutMs"])
+		assert.Contains(t, segment.Attributes, "deadline.remainingMs")
+		assert.Equal(t, timeoutSourceGateway, segment.Attributes["timeout.source"])
+	}
+}
+
+func Test_timeoutSource(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want string
+	}{
+		{
+			name: "given no error, it should return none",
+			ctx:  expired,
+		},
+		{
+			name: "given an expired context, it should blame the gateway",
+			ctx:  expired,
+			err:  context.DeadlineExceeded,
+			want: timeoutSourceGateway,
+		},
+		{
+			name: "given a deadline error of the backend, it should blame the backend",
+			ctx:  context.Background(),
+			err:  context.DeadlineExceeded,
+			want: timeoutSourceBackend,
+		},
+		{
+			name: "given a network timeout, it should blame the backend",
+			ctx:  context.Background(),
+			err:  timeoutError{},
+			want: timeoutSourceBackend,
+		},
+		{
+			name: "given another error, it should return none",
+			ctx:  context.Background(),
+			err:  errors.New("boom"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				assert.Equal(t, tt.want, timeoutSource(tt.ctx, tt.err))
+			},
+		)
+	}
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// ginTransactionKey is the key of the transaction in the gin context.
+// gin only looks up string keys, and the lura contexts are derived from the gin context,
+// so the transaction stored with it can be found from the proxies and the backends.
+const ginTransactionKey = "krakendNewRelicTransaction"
+
+type transactionContextKey struct{}
+
+// requestTransactions holds the transactions attached to the proxy requests, by request.
+// Nothing is written in the requests, so the transactions are never sent to the backends or seen by the scripts.
+var requestTransactions sync.Map
+
+// ContextWithTransaction returns a context holding the transaction, so the proxies and backends called with it
+// are instrumented. Use it when a custom proxy factory, modifier or plugin creates a new context.
+func ContextWithTransaction(ctx context.Context, txn Transaction) context.Context {
+	if txn == nil {
+		return ctx
+	}
+	if t := toNewRelicTransaction(txn); t != nil {
+		ctx = newrelic.NewContext(ctx, t)
+	}
+	return contextWithTransaction(ctx, txn)
+}
+
+// TransactionFromContext returns the transaction of the context, nil when there is none or the module is disabled
+func TransactionFromContext(ctx context.Context) Transaction {
+	if app == nil || ctx == nil {
+		return nil
+	}
+	return app.TransactionManager.TransactionFromContext(ctx)
+}
+
+// RequestWithTransaction attaches the transaction to the proxy request, so the proxies and backends called with it
+// are instrumented even when their context does not hold the transaction, e.g. after a plugin replaced it.
+// Only this request holds it, not its copies made with Clone or CloneRequest. The returned function detaches it,
+// call it once the request is done so the transaction is not kept.
+func RequestWithTransaction(req *proxy.Request, txn Transaction) func() {
+	if req == nil || txn == nil {
+		return func() {}
+	}
+	if _, loaded := requestTransactions.LoadOrStore(req, txn); loaded {
+		// the request already holds a transaction, detached by the one who attached it
+		return func() {}
+	}
+	return func() {
+		requestTransactions.Delete(req)
+	}
+}
+
+// TransactionFromRequest returns the transaction attached to the proxy request, nil when there is none
+func TransactionFromRequest(req *proxy.Request) Transaction {
+	if req == nil {
+		return nil
+	}
+	txn, ok := requestTransactions.Load(req)
+	if !ok {
+		return nil
+	}
+	return txn.(Transaction)
+}
+
+// transactionFor returns the transaction of the context, falling back to the one attached to the request.
+// The returned context holds it, so the calls made with it find it too.
+func transactionFor(ctx context.Context, req *proxy.Request) (context.Context, Transaction) {
+	if txn := app.TransactionManager.TransactionFromContext(ctx); txn != nil {
+		return ctx, txn
+	}
+	txn := TransactionFromRequest(req)
+	if txn == nil {
+		return ctx, nil
+	}
+	return ContextWithTransaction(ctx, txn), txn
+}
+
+func contextWithTransaction(ctx context.Context, txn Transaction) context.Context {
+	return context.WithValue(ctx, transactionContextKey{}, txn)
+}
+
+func transactionFromContext(ctx context.Context) Transaction {
+	if ctx == nil {
+		return nil
+	}
+	if txn, ok := ctx.Value(ginTransactionKey).(Transaction); ok {
+		return txn
+	}
+	if txn, ok := ctx.Value(transactionContextKey{}).(Transaction); ok {
+		return txn
+	}
+	return nil
+}
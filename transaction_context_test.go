@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextWithTransaction(t *testing.T) {
+	recorder := NewRecorder()
+	app = &Application{TransactionManager: recorder, NRApplication: recorder}
+	defer func() { app = nil }()
+
+	_, txn := recorder.StartTransactionContext(context.Background(), "/users")
+	ctx := ContextWithTransaction(context.Background(), txn)
+	assert.Equal(t, txn, TransactionFromContext(ctx))
+	assert.Nil(t, TransactionFromContext(context.Background()))
+	assert.Equal(t, context.Background(), ContextWithTransaction(context.Background(), nil))
+}
+
+func TestRequestWithTransaction(t *testing.T) {
+	recorder := NewRecorder()
+	app = &Application{TransactionManager: recorder, NRApplication: recorder}
+	defer func() { app = nil }()
+
+	_, txn := recorder.StartTransactionContext(context.Background(), "/users")
+	_, other := recorder.StartTransactionContext(context.Background(), "/orders")
+	req := &proxy.Request{Headers: map[string][]string{}}
+	release := RequestWithTransaction(req, txn)
+	assert.Equal(t, txn, TransactionFromRequest(req))
+	assert.Nil(t, TransactionFromRequest(proxy.CloneRequest(req)))
+
+	// the request keeps its transaction until it is released by the one who attached it
+	RequestWithTransaction(req, other)()
+	assert.Equal(t, txn, TransactionFromRequest(req))
+
+	release()
+	assert.Nil(t, TransactionFromRequest(req))
+	assert.Empty(t, req.Params)
+	assert.Empty(t, req.Headers)
+	assert.Nil(t, TransactionFromRequest(nil))
+}
+
+func TestNewProxyMiddleware_newContext(t *testing.T) {
+	tests := []struct {
+		name         string
+		carryOver    bool
+		sameRequest  bool
+		wantSegments []string
+	}{
+		{
+			name:         "given a plugin carrying the transaction over to its new context, it should instrument the backend",
+			carryOver:    true,
+			wantSegments: []string{"(proxy) /users", "External/backend:8080/http/GET"},
+		},
+		{
+			name:         "given a plugin passing the request over with a new context, it should instrument the backend",
+			sameRequest:  true,
+			wantSegments: []string{"(proxy) /users", "External/backend:8080/http/GET"},
+		},
+		{
+			name:         "given a plugin losing the transaction, it should not instrument the backend",
+			wantSegments: []string{"(proxy) /users"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				recorder := NewRecorder()
+				app = &Application{
+					TransactionManager: recorder,
+					NRApplication:      recorder,
+					Config:             Config{InstrumentationRate: 100},
+				}
+				defer func() { app = nil }()
+
+				backend := NewBackend(
+					"backend", func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+						return &proxy.Response{IsComplete: true, Metadata: proxy.Metadata{StatusCode: http.StatusOK}}, nil
+					},
+				)
+				// plugin replaces the context of the request
+				plugin := func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+					newCtx := context.Background()
+					if tt.carryOver {
+						newCtx = ContextWithTransaction(newCtx, TransactionFromContext(ctx))
+					}
+					if tt.sameRequest {
+						return backend(newCtx, req)
+					}
+					return backend(newCtx, proxy.CloneRequest(req))
+				}
+				p := NewProxyMiddleware("(proxy) /users")(plugin)
+
+				ctx, txn := recorder.StartTransactionContext(context.Background(), "/users")
+				backendURL, _ := url.Parse("http://backend:8080/users/1")
+				req := &proxy.Request{Method: http.MethodGet, URL: backendURL, Headers: map[string][]string{}}
+				_, err := p(ctx, req)
+				txn.End()
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				recorded, _ := recorder.Transaction("/users")
+				assert.Equal(t, tt.wantSegments, recorded.SegmentNames())
+				assert.Empty(t, req.Params)
+				assert.Nil(t, TransactionFromRequest(req))
+			},
+		)
+	}
+}